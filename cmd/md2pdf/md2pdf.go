@@ -1,12 +1,10 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -26,8 +24,21 @@ var author = flag.String("author", "", "Author; used if -footer is passed")
 var unicodeSupport = flag.String("unicode-encoding", "", "e.g 'cp1251'")
 var fontFile = flag.String("font-file", "", "path to font file to use")
 var fontName = flag.String("font-name", "", "Font name ID; e.g 'Helvetica-1251'")
+var codeFontFile = flag.String("code-font-file", "", "path to a monospace TrueType font file to set code in")
+var codeFontName = flag.String("code-font-name", "", "Font name ID of the code font; e.g 'DejaVuSansMono'")
 var themeArg = flag.String("theme", "light", "[light|dark]")
 var hrAsNewPage = flag.Bool("new-page-on-hr", false, "Interpret HR as a new page; useful for presentations")
+var endnotes = flag.Bool("endnotes", false, "Collect footnotes at the end of the document")
+var toc = flag.Bool("toc", false, "Add a table of contents at the start of the document, or in place of a [TOC] paragraph")
+var imageCaptions = flag.Bool("image-captions", false, "Draw a numbered caption, from the title or alt text, under each image")
+var imageDPI = flag.Float64("image-dpi", 0, "Downsample images with many more pixels than they need to this resolution; default is full resolution")
+var jpegQuality = flag.Int("jpeg-quality", 0, "Quality, 1 to 100, of downsampled and recompressed JPEG images; default is 85 for downsampled images only")
+var offline = flag.Bool("offline", false, "Fetch no remote input or images")
+var allowHosts = flag.String("allow-hosts", "", "Comma separated hosts, and their subdomains, that remote input and images may be fetched from; default is any host")
+var fetchTimeout = flag.Duration("fetch-timeout", 0, "Time limit of each fetch, e.g. '30s'; default is no limit")
+var maxFetchSize = flag.Int64("max-fetch-size", 0, "Most bytes a fetch may return; default is no limit")
+var codeLineNumbers = flag.Bool("code-line-numbers", false, "Number the lines of code blocks")
+var highlightPalette = flag.String("highlight-palette", "", "Syntax highlighting colours: default, solarized-light, solarized-dark, github or a JSON palette file; default depends on the theme")
 var printFooter = flag.Bool("with-footer", false, "Print doc footer (author  title  page number)")
 var pageSize = flag.String("page-size", "A4", "[A3 | A4 | A5]")
 var orientation = flag.String("orientation", "portrait", "[portrait | landscape]")
@@ -38,19 +49,6 @@ var _, fileName, fileLine, ok = runtime.Caller(0)
 
 var opts []mdtopdf.RenderOption
 
-func processRemoteInputFile(url string) ([]byte, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, errors.New("Received non 200 response code: " + fmt.Sprintf("HTTP %d", resp.StatusCode))
-	}
-	content, rerr := io.ReadAll(resp.Body)
-	return content, rerr
-}
-
 func glob(dir string, validExts []string) ([]string, error) {
 	files := []string{}
 	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
@@ -79,6 +77,40 @@ func main() {
 		opts = append(opts, mdtopdf.IsHorizontalRuleNewPage(true))
 	}
 
+	if *endnotes {
+		opts = append(opts, mdtopdf.WithEndnotes(true))
+	}
+
+	if *toc {
+		opts = append(opts, mdtopdf.WithTableOfContents(true))
+	}
+
+	if *codeFontFile != "" && *codeFontName != "" {
+		opts = append(opts, mdtopdf.WithCodeFont(*codeFontName, *codeFontFile))
+	}
+
+	if *codeLineNumbers {
+		opts = append(opts, mdtopdf.WithCodeLineNumbers(true))
+	}
+
+	if *imageCaptions {
+		opts = append(opts, mdtopdf.WithImageCaptions(true))
+	}
+
+	if *imageDPI > 0 {
+		opts = append(opts, mdtopdf.SetImageDPI(*imageDPI))
+	}
+
+	if *jpegQuality > 0 {
+		opts = append(opts, mdtopdf.SetJPEGQuality(*jpegQuality))
+	}
+
+	policy := mdtopdf.FetchPolicy{Offline: *offline, Timeout: *fetchTimeout, MaxSize: *maxFetchSize}
+	if *allowHosts != "" {
+		policy.AllowedHosts = strings.Split(*allowHosts, ",")
+	}
+	opts = append(opts, mdtopdf.WithFetchPolicy(policy))
+
 	if *unicodeSupport != "" {
 		opts = append(opts, mdtopdf.WithUnicodeTranslator(*unicodeSupport))
 	}
@@ -93,6 +125,8 @@ func main() {
 	var content []byte
 	var err error
 	var inputBaseURL string
+	// in directory mode, each file is rendered on its own
+	var inputFiles []mdtopdf.InputFile
 	if *input == "" {
 		content, err = io.ReadAll(os.Stdin)
 		if err != nil {
@@ -101,7 +135,7 @@ func main() {
 	} else {
 		httpRegex := regexp.MustCompile("^http(s)?://")
 		if httpRegex.Match([]byte(*input)) {
-			content, err = processRemoteInputFile(*input)
+			content, err = policy.Fetch(*input)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -120,15 +154,16 @@ func main() {
 				if err != nil {
 					log.Fatal(err)
 				}
-				for i, filePath := range files {
+				for _, filePath := range files {
 					fileContents, err := os.ReadFile(filePath)
 					if err != nil {
 						log.Fatal(err)
 					}
-					content = append(content, fileContents...)
-					if i < len(files)-1 {
-						content = append(content, []byte("---\n")...)
+					name, err := filepath.Rel(*input, filePath)
+					if err != nil {
+						log.Fatal(err)
 					}
+					inputFiles = append(inputFiles, mdtopdf.InputFile{Name: name, Content: fileContents})
 				}
 			} else {
 				content, err = os.ReadFile(*input)
@@ -150,6 +185,17 @@ func main() {
 		fillColor = mdtopdf.Colorlookup("black")
 	}
 
+	if *highlightPalette != "" {
+		palette, ok := mdtopdf.HighlightPaletteLookup(*highlightPalette)
+		if !ok {
+			palette, err = mdtopdf.LoadHighlightPalette(*highlightPalette)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		opts = append(opts, mdtopdf.WithHighlightPalette(theme, palette))
+	}
+
 	pf := mdtopdf.NewPdfRenderer(*orientation, *pageSize, *output, *logFile, opts, theme)
 	if inputBaseURL != "" {
 		pf.InputBaseURL = inputBaseURL
@@ -157,7 +203,7 @@ func main() {
 	pf.Pdf.SetSubject(*title, true)
 	pf.Pdf.SetTitle(*title, true)
 	pf.BackgroundColor = mdtopdf.Colorlookup(backgroundColor)
-	pf.Extensions = parser.NoIntraEmphasis | parser.Tables | parser.FencedCode | parser.Autolink | parser.Strikethrough | parser.SpaceHeadings | parser.HeadingIDs | parser.BackslashLineBreak | parser.DefinitionLists
+	pf.Extensions = parser.NoIntraEmphasis | parser.Tables | parser.FencedCode | parser.Autolink | parser.Strikethrough | parser.SpaceHeadings | parser.HeadingIDs | parser.AutoHeadingIDs | parser.BackslashLineBreak | parser.DefinitionLists | parser.Footnotes | parser.Attributes
 
 	if *fontFile != "" && *fontName != "" {
 		pf.Pdf.AddFont(*fontName, "", *fontFile)
@@ -193,7 +239,11 @@ func main() {
 		})
 	}
 
-	err = pf.Process(content)
+	if inputFiles != nil {
+		err = pf.ProcessFiles(inputFiles)
+	} else {
+		err = pf.Process(content)
+	}
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 	}
@@ -0,0 +1,153 @@
+/*
+ * Markdown to PDF Converter
+ * Available at http://github.com/mandolyte/mdtopdf
+ *
+ * Copyright © Cecil New <cecil.new@gmail.com>, Jesse Portnoy <jesse@packman.io>.
+ * Distributed under the MIT License.
+ * See README.md for details.
+ *
+ * Dependencies
+ * This package depends on two other packages:
+ *
+ * Go Markdown processor
+ *   Available at https://github.com/gomarkdown/markdown
+ *
+ * fpdf - a PDF document generator with high level support for
+ *   text, drawing and images.
+ *   Available at https://github.com/go-pdf/fpdf
+ */
+
+package mdtopdf
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// codeTabWidth is the number of columns between the tab stops of code
+// blocks.
+const codeTabWidth = 4
+
+// codeAttribute matches a key=value attribute of a code block, e.g.
+// hl_lines=[3,5-7], linenos=true or linenostart="10".
+var codeAttribute = regexp.MustCompile(`([\w-]+)\s*=\s*("[^"]*"|'[^']*'|\[[^\]]*\]|[^\s,}]+)`)
+
+// fencedCodeHook parses a fenced code block whose language is followed
+// by attributes, e.g. ```go {hl_lines=[3,5-7]}, which the parser only
+// reads as a fence if the language is inside the braces as well. The
+// info string of the block is the whole of the fence line after the
+// fence.
+func fencedCodeHook(data []byte) (ast.Node, []byte, int) {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return nil, nil, 0
+	}
+	line := string(data[:end])
+	indent := len(line) - len(strings.TrimLeft(line, " "))
+	if indent > 3 {
+		return nil, nil, 0
+	}
+	line = line[indent:]
+	marker := fenceMarker(line)
+	if marker == "" {
+		return nil, nil, 0
+	}
+	info := strings.TrimSpace(line[len(marker):])
+	lang, attrs, ok := strings.Cut(info, "{")
+	if !ok || strings.TrimSpace(lang) == "" || strings.ContainsAny(lang, "`") ||
+		!strings.HasSuffix(attrs, "}") {
+		return nil, nil, 0
+	}
+	var literal bytes.Buffer
+	for i := end + 1; i < len(data); {
+		next := bytes.IndexByte(data[i:], '\n')
+		if next < 0 {
+			next = len(data) - i
+		}
+		l := string(data[i : i+next])
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, marker) && strings.Trim(trimmed, marker[:1]) == "" {
+			consumed := i + next
+			if consumed < len(data) {
+				consumed++
+			}
+			block := &ast.CodeBlock{IsFenced: true, Info: []byte(info)}
+			block.Literal = literal.Bytes()
+			return block, nil, consumed
+		}
+		literal.WriteString(l)
+		literal.WriteByte('\n')
+		i += next + 1
+	}
+	// without a closing fence, it is no code block
+	return nil, nil, 0
+}
+
+// fenceMarker returns the ``` or ~~~ fence at the start of line, if any.
+func fenceMarker(line string) string {
+	if line == "" || (line[0] != '`' && line[0] != '~') {
+		return ""
+	}
+	n := len(line) - len(strings.TrimLeft(line, line[:1]))
+	if n < 3 {
+		return ""
+	}
+	return line[:n]
+}
+
+// codeBlockInfo splits the info string of a code block into its
+// language and attributes. Attributes may follow the language in braces,
+// "go {hl_lines=[3,5-7]}", or share the braces with it, "{go linenos=true}".
+func codeBlockInfo(info string) (lang string, attrs map[string]string) {
+	info = strings.TrimSpace(info)
+	fields := strings.FieldsFunc(info, func(r rune) bool {
+		return r == '{' || r == '}' || unicode.IsSpace(r)
+	})
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		lang = strings.TrimPrefix(fields[0], ".")
+	}
+	attrs = map[string]string{}
+	for _, m := range codeAttribute.FindAllStringSubmatch(info, -1) {
+		attrs[strings.ToLower(m[1])] = strings.Trim(m[2], `"'`)
+	}
+	return lang, attrs
+}
+
+// lineSet parses the lines of an hl_lines attribute, e.g. "[3,5-7]" or
+// "3 5-7", into a set of line numbers, of the first count lines only. A
+// range may also run backwards, "7-5"; fields that aren't numbers or
+// ranges are left out.
+func lineSet(value string, count int) map[int]bool {
+	lines := map[int]bool{}
+	value = strings.Trim(value, "[]")
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		first, last, isRange := strings.Cut(field, "-")
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			continue
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(last); err != nil {
+				continue
+			}
+		}
+		if to < from {
+			from, to = to, from
+		}
+		if from < 1 {
+			from = 1
+		}
+		for n := from; n <= to && n <= count; n++ {
+			lines[n] = true
+		}
+	}
+	return lines
+}
@@ -19,6 +19,8 @@
 
 package mdtopdf
 
+import "github.com/gomarkdown/markdown/ast"
+
 type listType int
 
 const (
@@ -28,13 +30,6 @@ const (
 	definition
 )
 
-// This slice of float64 contains the width of each cell
-// in the header of a table. These will be the widths used
-// in the table body as well.
-var cellwidths []float64
-var curdatacell int
-var fill = false
-
 func (n listType) String() string {
 	switch n {
 	case notlist:
@@ -58,11 +53,89 @@ type containerState struct {
 	listkind   listType
 	itemNumber int // only if an ordered list
 
-	// populated if node type is a link
+	// populated if node type is a link; anchor is the fpdf internal
+	// link of a #ID destination
 	destination string
+	anchor      int
 
 	// populated if table cell
 	isHeader bool
+
+	// populated if table, or one of its sections, rows or cells
+	table *tableState
+
+	// populated if table row
+	rowTop, rowHeight float64
+
+	// populated if caption figure
+	caption     string
+	captionDone bool
+}
+
+// tableState is the layout of the table being drawn. Each table gets
+// its own, so that neither separate renderers nor nested tables share
+// any table state.
+type tableState struct {
+	// width of each column, measured from the header and body
+	// cells before the first row is drawn
+	cellwidths  []float64
+	curdatacell int
+	fill        bool
+
+	// the header section, whose rows are repeated when the
+	// table breaks across pages
+	header ast.Node
+}
+
+func (t *tableState) width() float64 {
+	wSum := 0.0
+	for _, w := range t.cellwidths {
+		wSum += w
+	}
+	return wSum
+}
+
+// footnote is a note referenced from the text. The marker in the text
+// and the note itself link to each other with fpdf internal links.
+type footnote struct {
+	number int
+	// the item of the footnotes list that holds the note text
+	item ast.Node
+	// links to the first marker and to the note
+	markerLink, noteLink int
+	// set once the note has been given a place on a page
+	placed bool
+}
+
+// contents is the table of contents of a document. Pages are kept free
+// where the contents go, and filled in once the page of every heading
+// is known.
+type contents struct {
+	entries  []*contentsEntry
+	headings map[*ast.Heading]*contentsEntry
+	// the pages kept free for the contents, and the printable area
+	// of those pages
+	firstPage, pages int
+	top, bottom      float64
+}
+
+type contentsEntry struct {
+	level int
+	text  string
+	// fpdf internal link to the heading, and the page it is on
+	link, page int
+}
+
+// codeBlockLayout is the gutter and line shading of a code block.
+type codeBlockLayout struct {
+	// the left margin of the block, the first line number, if the lines
+	// are numbered, and the width of the gutter the numbers are set in
+	left      float64
+	numbered  bool
+	firstLine int
+	gutter    float64
+	// lines to shade, counted from 1
+	highlight map[int]bool
 }
 
 type states struct {
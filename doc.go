@@ -32,6 +32,14 @@ a number of features. The test PDF was created with this command:
 
 	go run convert.go -i test.md -o test.pdf
 
+# Concurrency
+
+A PdfRenderer is not safe for concurrent use, but separate renderers
+may convert documents in parallel goroutines. The state they share, the
+syntax highlighting groups of gohighlight and an ImageCache set with
+WithImageCache, is locked; a ResourceLoader given to several renderers
+has to be safe for concurrent use as well.
+
 See README for limitations and known issues
 */
 package mdtopdf
@@ -0,0 +1,129 @@
+/*
+ * Markdown to PDF Converter
+ * Available at http://github.com/mandolyte/mdtopdf
+ *
+ * Copyright © Cecil New <cecil.new@gmail.com>, Jesse Portnoy <jesse@packman.io>.
+ * Distributed under the MIT License.
+ * See README.md for details.
+ *
+ * Dependencies
+ * This package depends on two other packages:
+ *
+ * Go Markdown processor
+ *   Available at https://github.com/gomarkdown/markdown
+ *
+ * fpdf - a PDF document generator with high level support for
+ *   text, drawing and images.
+ *   Available at https://github.com/go-pdf/fpdf
+ */
+
+package mdtopdf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxRedirects is the number of redirects a fetch follows, as for the
+// default http.Client.
+const maxRedirects = 10
+
+// FetchPolicy controls how remote images, and remote input in md2pdf,
+// are fetched. The zero value fetches from any host, without a time or
+// size limit.
+type FetchPolicy struct {
+	// Offline turns off network access completely
+	Offline bool
+	// AllowedHosts, if not empty, are the only hosts fetched from; a
+	// host also allows its subdomains. Redirects are held to the same
+	// list.
+	AllowedHosts []string
+	// Timeout is the time limit of each request, including redirects
+	// and reading the body
+	Timeout time.Duration
+	// MaxSize is the most bytes a fetch may return
+	MaxSize int64
+}
+
+// Fetch gets the content at an http or https URL under the policy.
+func (p FetchPolicy) Fetch(rawURL string) ([]byte, error) {
+	if err := p.check(rawURL); err != nil {
+		return nil, err
+	}
+	client := http.Client{
+		Timeout: p.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return p.check(req.URL.String())
+		},
+	}
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", "curl/7.84.0")
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, errors.New("Received non 200 response code: " + fmt.Sprintf("HTTP %d", response.StatusCode))
+	}
+	if p.MaxSize > 0 && response.ContentLength > p.MaxSize {
+		return nil, fmt.Errorf("%v: size %d is over the limit of %d bytes", rawURL, response.ContentLength, p.MaxSize)
+	}
+	body := io.Reader(response.Body)
+	if p.MaxSize > 0 {
+		// one byte over tells a body at the limit from a longer one
+		body = io.LimitReader(body, p.MaxSize+1)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if p.MaxSize > 0 && int64(len(content)) > p.MaxSize {
+		return nil, fmt.Errorf("%v: size is over the limit of %d bytes", rawURL, p.MaxSize)
+	}
+	return content, nil
+}
+
+// check tells why a URL may not be fetched, if it may not.
+func (p FetchPolicy) check(rawURL string) error {
+	if p.Offline {
+		return fmt.Errorf("%v: network access is turned off", rawURL)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%v: only http and https URLs are fetched", rawURL)
+	}
+	if !p.allowed(u.Hostname()) {
+		return fmt.Errorf("%v: host %v is not allowed", rawURL, u.Hostname())
+	}
+	return nil
+}
+
+func (p FetchPolicy) allowed(host string) bool {
+	if len(p.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(strings.Trim(strings.TrimSpace(allowed), "."))
+		if allowed != "" && (host == allowed || strings.HasSuffix(host, "."+allowed)) {
+			return true
+		}
+	}
+	return false
+}
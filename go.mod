@@ -3,19 +3,18 @@ module github.com/mandolyte/mdtopdf
 go 1.18
 
 require (
-	github.com/canhlinh/svg2png v0.0.0-20201124065332-6ba87c82371f
 	github.com/gabriel-vasile/mimetype v1.4.2
 	github.com/go-pdf/fpdf v0.9.0
 	github.com/gomarkdown/markdown v0.0.0-20240729212818-a2a9c4f76ef5
 	github.com/jessp01/gohighlight v0.21.1-7
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20220730225603-2ab79fcdd4ef
 	golang.org/x/exp v0.0.0-20240707233637-46b078467d37
+	golang.org/x/image v0.12.0
 )
 
 require (
-	github.com/mcuadros/go-version v0.0.0-20190830083331-035f6764e8d2 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
 	golang.org/x/net v0.33.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,372 @@
+/*
+ * Markdown to PDF Converter
+ * Available at http://github.com/mandolyte/mdtopdf
+ *
+ * Copyright © Cecil New <cecil.new@gmail.com>, Jesse Portnoy <jesse@packman.io>.
+ * Distributed under the MIT License.
+ * See README.md for details.
+ *
+ * Dependencies
+ * This package depends on two other packages:
+ *
+ * Go Markdown processor
+ *   Available at https://github.com/gomarkdown/markdown
+ *
+ * fpdf - a PDF document generator with high level support for
+ *   text, drawing and images.
+ *   Available at https://github.com/go-pdf/fpdf
+ */
+
+package mdtopdf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/go-pdf/fpdf"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+
+	"golang.org/x/image/draw"
+
+	// decoders for the images that are converted to PNG
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// defaultJPEGQuality is the quality of JPEG images that are downsampled
+// when no JPEGQuality is set.
+const defaultJPEGQuality = 85
+
+// svgDPI is the resolution SVG images are rasterised at, and
+// svgMaxPixels caps the longer side of the raster.
+const (
+	svgDPI       = 300
+	svgMaxPixels = 4096
+)
+
+// ImageCache keeps images ready to be registered with fpdf, converted
+// if need be, keyed by the hash of their content and, for remote images,
+// by URL and FetchPolicy. A cache may be shared between renderers, with
+// WithImageCache, so that each image is fetched and converted once;
+// renderers that want an image another one is loading wait for it. It is
+// safe for concurrent use.
+//
+// A cache is never emptied: it holds every image it has been given, and
+// every downsampled or recompressed copy of them, for as long as it is
+// used. A long-running service should start a new cache from time to
+// time rather than share one for good.
+type ImageCache struct {
+	mu      sync.Mutex
+	images  map[string]*cachedImage
+	loading map[string]*imageLoad
+}
+
+// cachedImage is an image in a type fpdf reads.
+type cachedImage struct {
+	// the hash of the original image, which is also the name the image
+	// is registered with fpdf under
+	key     string
+	data    []byte
+	options fpdf.ImageOptions
+	// the size in pixels, and the resolution
+	width, height int
+	dpi           float64
+}
+
+// imageLoad is an image that is being loaded.
+type imageLoad struct {
+	done chan struct{}
+	img  *cachedImage
+	err  error
+}
+
+// NewImageCache creates an empty ImageCache.
+func NewImageCache() *ImageCache {
+	return &ImageCache{images: map[string]*cachedImage{}, loading: map[string]*imageLoad{}}
+}
+
+// load returns the image under key, calling fn to load it if the cache
+// doesn't have it, and reports whether it was cached or loaded by another
+// caller. Callers that want the same image at the same time wait for the
+// first one to load it, and share its error if it fails; an image that
+// fails to load isn't cached.
+func (c *ImageCache) load(key string, fn func() (*cachedImage, error)) (*cachedImage, bool, error) {
+	c.mu.Lock()
+	if img := c.images[key]; img != nil {
+		c.mu.Unlock()
+		return img, true, nil
+	}
+	if l := c.loading[key]; l != nil {
+		c.mu.Unlock()
+		<-l.done
+		return l.img, true, l.err
+	}
+	l := &imageLoad{done: make(chan struct{})}
+	c.loading[key] = l
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.loading, key)
+		if l.err == nil && l.img != nil {
+			c.images[key] = l.img
+		}
+		c.mu.Unlock()
+		close(l.done)
+	}()
+	l.img, l.err = fn()
+	return l.img, false, l.err
+}
+
+// imageKey returns the content address of an image.
+func imageKey(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// lengthUnits are the points per unit of the lengths of images; a
+// length without a unit is in pixels.
+var lengthUnits = []struct {
+	suffix string
+	points float64
+}{
+	{"px", 0.75}, {"pt", 1}, {"pc", 12}, {"mm", 72 / 25.4}, {"cm", 72 / 2.54}, {"in", 72}, {"", 0.75},
+}
+
+// parseLength converts a length such as "300", "300px", "4cm" or "2in"
+// to points.
+func parseLength(value string) (float64, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return 0, false
+	}
+	for _, u := range lengthUnits {
+		if !strings.HasSuffix(value, u.suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), 64)
+		if err != nil || n <= 0 {
+			return 0, false
+		}
+		return n * u.points, true
+	}
+	return 0, false
+}
+
+// svgBox is the viewBox of an SVG image, in user units.
+type svgBox struct {
+	x, y, w, h float64
+}
+
+// svgSize returns the size of an SVG image in points and its viewBox.
+// A missing width or height follows from the other one and the aspect
+// ratio of the viewBox; without either, the viewBox is taken in pixels,
+// and without a viewBox the image is 300 by 150 pixels, as in browsers.
+func svgSize(data []byte) (width, height float64, box svgBox, err error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	// the encoding of the image doesn't matter for its root element
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	var root *xml.StartElement
+	for root == nil {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, 0, box, fmt.Errorf("svg: no svg element: %w", err)
+		}
+		if se, ok := token.(xml.StartElement); ok {
+			if se.Name.Local != "svg" {
+				return 0, 0, box, errors.New("svg: root element is " + se.Name.Local)
+			}
+			root = &se
+		}
+	}
+	var hasWidth, hasHeight, hasBox bool
+	for _, attr := range root.Attr {
+		switch attr.Name.Local {
+		case "width":
+			width, hasWidth = parseLength(attr.Value)
+		case "height":
+			height, hasHeight = parseLength(attr.Value)
+		case "viewBox":
+			box, hasBox = parseViewBox(attr.Value)
+		}
+	}
+	switch {
+	case hasWidth && hasHeight:
+	case hasWidth && hasBox:
+		height = width * box.h / box.w
+	case hasHeight && hasBox:
+		width = height * box.w / box.h
+	case hasBox:
+		width, height = box.w*0.75, box.h*0.75
+	default:
+		if !hasWidth {
+			width = 300 * 0.75
+		}
+		if !hasHeight {
+			height = 150 * 0.75
+		}
+	}
+	if !hasBox {
+		// user units are pixels
+		box = svgBox{0, 0, width / 0.75, height / 0.75}
+	}
+	return width, height, box, nil
+}
+
+// parseViewBox parses a viewBox such as "0 0 100 50".
+func parseViewBox(value string) (svgBox, bool) {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(fields) != 4 {
+		return svgBox{}, false
+	}
+	var v [4]float64
+	for i, f := range fields {
+		n, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return svgBox{}, false
+		}
+		v[i] = n
+	}
+	return svgBox{v[0], v[1], v[2], v[3]}, v[2] > 0 && v[3] > 0
+}
+
+// rasterizeSVG draws an SVG image into a PNG image. It returns the PNG
+// image and its resolution, at which the PNG image has the size of the
+// SVG image. The viewBox is fitted into the image and centred, as for
+// the default preserveAspectRatio of "xMidYMid meet".
+func rasterizeSVG(data []byte) (pngData []byte, dpi float64, err error) {
+	width, height, box, err := svgSize(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, 0, fmt.Errorf("svg: %w", err)
+	}
+	dpi = svgDPI
+	if longer := math.Max(width, height) * dpi / 72; longer > svgMaxPixels {
+		dpi = svgDPI * svgMaxPixels / longer
+	}
+	w := int(math.Ceil(width * dpi / 72))
+	h := int(math.Ceil(height * dpi / 72))
+	if w <= 0 || h <= 0 {
+		return nil, 0, errors.New("svg: empty image")
+	}
+	scale := math.Min(float64(w)/box.w, float64(h)/box.h)
+	icon.Transform = rasterx.Identity.
+		Translate((float64(w)-box.w*scale)/2, (float64(h)-box.h*scale)/2).
+		Scale(scale, scale).
+		Translate(-box.x, -box.y)
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, 0, err
+	}
+	// the raster is rounded up to whole pixels
+	return buf.Bytes(), float64(w) * 72 / width, nil
+}
+
+// pngSupported tells if fpdf can read a PNG image: it reads neither
+// 16-bit nor interlaced images.
+func pngSupported(data []byte) bool {
+	// the bit depth and interlace method in the IHDR chunk
+	return len(data) > 28 && data[24] <= 8 && data[28] == 0
+}
+
+// convertImage decodes an image of any of the registered formats and
+// encodes it as an 8-bit PNG image. Of an animated image, only the first
+// frame is kept.
+func convertImage(data []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+		nrgba := image.NewNRGBA(img.Bounds())
+		draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = nrgba
+	case *image.Gray16:
+		gray := image.NewGray(img.Bounds())
+		draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = gray
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pngDPI returns the resolution of a PNG image, read the way fpdf reads
+// it, or 72 if the image doesn't have one.
+func pngDPI(data []byte) float64 {
+	// chunks of length, type, data and CRC follow the signature
+	for i := 8; i+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		chunk := string(data[i+4 : i+8])
+		if chunk == "IEND" || i+8+n > len(data) {
+			break
+		}
+		if chunk == "pHYs" && n >= 9 {
+			x := binary.BigEndian.Uint32(data[i+8:])
+			y := binary.BigEndian.Uint32(data[i+12:])
+			if x == y {
+				if data[i+16] == 1 {
+					// pixels per meter
+					return float64(x) / 39.3701
+				}
+				return float64(x)
+			}
+		}
+		i += 12 + n
+	}
+	return 72
+}
+
+// resampleImage scales an image to w by h pixels, and encodes it as a
+// JPEG image of the given quality, or else as a PNG image.
+func resampleImage(data []byte, w, h int, asJPEG bool, quality int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if w == src.Bounds().Dx() && h == src.Bounds().Dy() {
+		draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Src)
+	} else {
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	}
+	var buf bytes.Buffer
+	if asJPEG {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	return buf.Bytes(), err
+}
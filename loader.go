@@ -0,0 +1,146 @@
+/*
+ * Markdown to PDF Converter
+ * Available at http://github.com/mandolyte/mdtopdf
+ *
+ * Copyright © Cecil New <cecil.new@gmail.com>, Jesse Portnoy <jesse@packman.io>.
+ * Distributed under the MIT License.
+ * See README.md for details.
+ *
+ * Dependencies
+ * This package depends on two other packages:
+ *
+ * Go Markdown processor
+ *   Available at https://github.com/gomarkdown/markdown
+ *
+ * fpdf - a PDF document generator with high level support for
+ *   text, drawing and images.
+ *   Available at https://github.com/go-pdf/fpdf
+ */
+
+package mdtopdf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ResourceLoader loads the images of a document, and the files it
+// includes with the parser.Includes extension, by the name they have in
+// the markdown, e.g. "./image/logo.png" or "https://example.com/a.svg".
+type ResourceLoader interface {
+	Load(name string) ([]byte, error)
+}
+
+// ResourceLoaderFunc is a function that is a ResourceLoader.
+type ResourceLoaderFunc func(name string) ([]byte, error)
+
+// Load calls f(name).
+func (f ResourceLoaderFunc) Load(name string) ([]byte, error) {
+	return f(name)
+}
+
+// FSLoader returns a ResourceLoader that reads from fsys, e.g. an
+// embed.FS. Names are taken relative to the root of fsys; URLs are not
+// found.
+func FSLoader(fsys fs.FS) ResourceLoader {
+	return ResourceLoaderFunc(func(name string) ([]byte, error) {
+		if isRemote(name) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return fs.ReadFile(fsys, strings.TrimPrefix(path.Clean("/"+name), "/"))
+	})
+}
+
+// loadResource loads an image or included file with the ResourceLoader;
+// data: URIs are decoded instead. Without a ResourceLoader, URLs are
+// fetched under the FetchPolicy and other names are read from disk, or
+// else fetched from InputBaseURL.
+func (r *PdfRenderer) loadResource(name string) ([]byte, error) {
+	if isDataURI(name) {
+		return decodeDataURI(name)
+	}
+	if r.ResourceLoader != nil {
+		return r.ResourceLoader.Load(name)
+	}
+	if isRemote(name) {
+		return r.FetchPolicy.Fetch(name)
+	}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) && r.InputBaseURL != "" {
+		return r.FetchPolicy.Fetch(r.InputBaseURL + "/" + strings.TrimPrefix(name, "./"))
+	}
+	return data, err
+}
+
+// readInclude reads a file included with the parser.Includes extension,
+// {{file}}, relative to the directory of the including file. An address
+// of "start,end" takes those lines only; either may be left out.
+func (r *PdfRenderer) readInclude(from, name string, address []byte) []byte {
+	if !path.IsAbs(name) && !isRemote(name) {
+		name = path.Join(from, name)
+	}
+	data, err := r.loadResource(name)
+	if err != nil {
+		log.Printf("include: %v", err)
+		return nil
+	}
+	start, end, ok := strings.Cut(string(address), ",")
+	if !ok {
+		return data
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	first, last := 1, len(lines)
+	if n, err := strconv.Atoi(strings.TrimSpace(start)); err == nil && n > first {
+		first = n
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(end)); err == nil && n < last {
+		last = n
+	}
+	if first > last {
+		return nil
+	}
+	return bytes.Join(lines[first-1:last], nil)
+}
+
+// decodeDataURI returns the data of a data: URI, either base64 or
+// percent-encoded, e.g. "data:image/png;base64,iVBORw0KGgo..." or
+// "data:image/svg+xml,%3Csvg...". The media type is left out; the type
+// of an image is taken from its content.
+func decodeDataURI(uri string) ([]byte, error) {
+	header, payload, ok := strings.Cut(uri[len("data:"):], ",")
+	if !ok {
+		return nil, errors.New("data URI without a comma")
+	}
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, fmt.Errorf("data URI: %w", err)
+	}
+	if !strings.HasSuffix(strings.ToLower(header), ";base64") {
+		return []byte(data), nil
+	}
+	data = strings.Join(strings.Fields(data), "")
+	// some encoders leave out the padding or use the URL alphabet
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(data); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, errors.New("data URI: invalid base64 data")
+}
+
+func isDataURI(name string) bool {
+	return len(name) > 5 && strings.EqualFold(name[:5], "data:")
+}
+
+func isRemote(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
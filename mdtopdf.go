@@ -25,7 +25,7 @@ import (
 	"fmt"
 	"io"
 	"os"
-
+	"path/filepath"
 	"strings"
 
 	"github.com/go-pdf/fpdf"
@@ -53,6 +53,26 @@ type Styler struct {
 	FillColor Color
 }
 
+// CaptionPosition places captions above or below their table or figure
+type CaptionPosition int
+
+const (
+	// CaptionBelow const
+	CaptionBelow CaptionPosition = iota
+	// CaptionAbove const
+	CaptionAbove
+)
+
+// InputFile is one of the markdown files that make up a document; see
+// ProcessFiles.
+type InputFile struct {
+	// Name is the path of the file relative to the other files, which
+	// links between the files use; its base name without extension is
+	// the title of the file's bookmark
+	Name    string
+	Content []byte
+}
+
 // RenderOption allows to define functions to configure the renderer
 type RenderOption func(r *PdfRenderer)
 
@@ -68,6 +88,9 @@ const (
 
 // PdfRenderer is the struct to manage conversion of a markdown object
 // to PDF format.
+//
+// A PdfRenderer is not safe for concurrent use; see the package
+// documentation.
 type PdfRenderer struct {
 	// Pdf can be used to access the underlying created fpdf object
 	// prior to processing the markdown source
@@ -108,18 +131,78 @@ type PdfRenderer struct {
 	// Table styling
 	THeader Styler
 	TBody   Styler
+	TFooter Styler
+
+	// Table and figure captions
+	Caption         Styler
+	CaptionPosition CaptionPosition
+	// ImageCaptions draws a numbered caption under each image
+	ImageCaptions bool
+	tableNumber   int
+	figureNumber  int
+
+	// Footnotes are drawn at the bottom of the page that references
+	// them, or at the end of the document if Endnotes is set
+	Footnote    Styler
+	Endnotes    bool
+	footnotes   map[int]*footnote
+	pageNotes   []*footnote // notes to draw at the bottom of this page
+	nextNotes   []*footnote // notes that did not fit on this page
+	notesHeight float64     // space kept free for pageNotes
+	breakMargin float64     // auto page break margin without the notes
+
+	// Table of contents, placed at the start of the document or at a
+	// [TOC] paragraph
+	TOC             Styler
+	TableOfContents bool
+	TOCTitle        string
+	contents        *contents
+
+	// Headings down to level BookmarkDepth become bookmarks in the PDF
+	// outline, nested below a bookmark for their file if there are
+	// several files
+	BookmarkDepth int
+	bookmarkBase  int
+	bookmarkLevel int
+
+	// every file of the document and every heading has an fpdf
+	// internal link; headings with an ID are also the target of #ID
+	// links
+	fileLinks      map[string]int
+	headingLinks   map[*ast.Heading]int
+	anchors        map[string]int
+	missingAnchors map[string]bool
+	file           string
+
+	// the style last set with setStyler
+	current Styler
 
 	cs states
 
 	// code styling
 	Code Styler
+	// CodeLineNumbers numbers the lines of code blocks, in the LineNumber
+	// style; lines chosen with hl_lines are shaded in CodeHighlightColor
+	CodeLineNumbers    bool
+	LineNumber         Styler
+	CodeHighlightColor Color
+	// HighlightPalette styles the tokens of syntax highlighted code
+	// blocks; each theme has its own
+	HighlightPalette HighlightPalette
 
 	// update styling
 	NeedCodeStyleUpdate       bool
 	NeedBlockquoteStyleUpdate bool
 	HorizontalRuleNewPage     bool
+	TableKeepTogether         bool
+	ImageMaxWidth             float64
 	SyntaxHighlightBaseDir    string
 	InputBaseURL              string
+	FetchPolicy               FetchPolicy
+	ResourceLoader            ResourceLoader
+	ImageCache                *ImageCache
+	ImageDPI                  float64
+	JPEGQuality               int
 	Theme                     Theme
 	BackgroundColor           Color
 	documentMatter            ast.DocumentMatters // keep track of front/main/back matter.
@@ -139,7 +222,7 @@ func (r *PdfRenderer) SetLightTheme() {
 		TextColor: Colorlookup("cornflowerblue")}
 
 	// Backticked text
-	r.Backtick = Styler{Font: "Times", Style: "", Size: 12, Spacing: 2,
+	r.Backtick = Styler{Font: "Courier", Style: "", Size: 12, Spacing: 2,
 		TextColor: Color{37, 27, 14}, FillColor: Color{200, 200, 200}}
 
 	// Quoted Text
@@ -148,9 +231,15 @@ func (r *PdfRenderer) SetLightTheme() {
 		TextColor: Color{37, 27, 14}, FillColor: Color{200, 200, 200}}
 
 	// Code text
-	r.Code = Styler{Font: "Times", Style: "", Size: 12, Spacing: 2,
+	r.Code = Styler{Font: "Courier", Style: "", Size: 12, Spacing: 2,
 		TextColor: Color{37, 27, 14}, FillColor: Color{200, 200, 200}}
 
+	// Code line numbers and highlighted lines
+	r.LineNumber = Styler{Font: "Courier", Style: "", Size: 10, Spacing: 2,
+		TextColor: Color{128, 128, 128}, FillColor: Colorlookup("white")}
+	r.CodeHighlightColor = Color{255, 243, 176}
+	r.HighlightPalette, _ = HighlightPaletteLookup("default")
+
 	// Headings
 	r.H1 = Styler{Font: "Arial", Style: "b", Size: 24, Spacing: 5,
 		TextColor: Colorlookup("black"), FillColor: Colorlookup("white")}
@@ -176,6 +265,22 @@ func (r *PdfRenderer) SetLightTheme() {
 	r.TBody = Styler{Font: "Arial", Style: "", Size: 12, Spacing: 2,
 		TextColor: Colorlookup("black"), FillColor: Color{240, 240, 240}}
 
+	// Table Footer Text
+	r.TFooter = Styler{Font: "Arial", Style: "b", Size: 12, Spacing: 2,
+		TextColor: Colorlookup("black"), FillColor: Color{220, 220, 220}}
+
+	// Caption Text
+	r.Caption = Styler{Font: "Arial", Style: "i", Size: 10, Spacing: 2,
+		TextColor: Colorlookup("black"), FillColor: Colorlookup("white")}
+
+	// Footnote Text
+	r.Footnote = Styler{Font: "Arial", Style: "", Size: 9, Spacing: 2,
+		TextColor: Colorlookup("black"), FillColor: Colorlookup("white")}
+
+	// Table of contents Text
+	r.TOC = Styler{Font: "Arial", Style: "", Size: 12, Spacing: 4,
+		TextColor: Colorlookup("black"), FillColor: Colorlookup("white")}
+
 }
 
 // SetDarkTheme sets theme to 'dark'
@@ -195,13 +300,19 @@ func (r *PdfRenderer) SetDarkTheme() {
 		TextColor: Colorlookup("cornflowerblue")}
 
 	// Backticked text
-	r.Backtick = Styler{Font: "Times", Style: "", Size: 12, Spacing: 2,
+	r.Backtick = Styler{Font: "Courier", Style: "", Size: 12, Spacing: 2,
 		TextColor: Colorlookup("lightgrey"), FillColor: Color{32, 35, 37}}
 
 	// Code text
-	r.Code = Styler{Font: "Times", Style: "", Size: 12, Spacing: 2,
+	r.Code = Styler{Font: "Courier", Style: "", Size: 12, Spacing: 2,
 		TextColor: Colorlookup("lightgrey"), FillColor: Color{32, 35, 37}}
 
+	// Code line numbers and highlighted lines
+	r.LineNumber = Styler{Font: "Courier", Style: "", Size: 10, Spacing: 2,
+		TextColor: Color{128, 128, 128}, FillColor: Colorlookup("black")}
+	r.CodeHighlightColor = Color{68, 64, 40}
+	r.HighlightPalette, _ = HighlightPaletteLookup("solarized-dark")
+
 	// Headings
 	r.H1 = Styler{Font: "Arial", Style: "b", Size: 24, Spacing: 5,
 		FillColor: Colorlookup("black"), TextColor: Colorlookup("darkgray")}
@@ -227,6 +338,22 @@ func (r *PdfRenderer) SetDarkTheme() {
 	r.TBody = Styler{Font: "Arial", Style: "", Size: 12, Spacing: 2,
 		FillColor: Color{200, 200, 200}, TextColor: Color{128, 128, 128}}
 
+	// Table Footer Text
+	r.TFooter = Styler{Font: "Arial", Style: "b", Size: 12, Spacing: 2,
+		TextColor: Colorlookup("darkgray"), FillColor: Color{45, 45, 45}}
+
+	// Caption Text
+	r.Caption = Styler{Font: "Arial", Style: "i", Size: 10, Spacing: 2,
+		FillColor: Colorlookup("black"), TextColor: Colorlookup("darkgray")}
+
+	// Footnote Text
+	r.Footnote = Styler{Font: "Arial", Style: "", Size: 9, Spacing: 2,
+		FillColor: Colorlookup("black"), TextColor: Colorlookup("darkgray")}
+
+	// Table of contents Text
+	r.TOC = Styler{Font: "Arial", Style: "", Size: 12, Spacing: 4,
+		FillColor: Colorlookup("black"), TextColor: Colorlookup("darkgray")}
+
 }
 
 // NewPdfRenderer creates and configures an PdfRenderer object,
@@ -252,6 +379,8 @@ func NewPdfRenderer(orient, papersz, pdfFile, tracerFile string, opts []RenderOp
 	}
 
 	r.fontdir = "."
+	r.TOCTitle = "Contents"
+	r.BookmarkDepth = 6
 
 	r.Theme = theme
 	if theme == 0 {
@@ -263,6 +392,15 @@ func NewPdfRenderer(orient, papersz, pdfFile, tracerFile string, opts []RenderOp
 	r.Pdf.SetHeaderFunc(func() {
 		r.SetPageBackground("", r.BackgroundColor)
 	})
+	// footnotes are drawn in the space kept free for them just before
+	// the page is left
+	r.Pdf.SetAcceptPageBreakFunc(func() bool {
+		auto, _ := r.Pdf.GetAutoPageBreak()
+		if auto {
+			r.drawFootnotes()
+		}
+		return auto
+	})
 
 	r.Pdf.AddPage()
 	switch r.Theme {
@@ -303,6 +441,19 @@ func NewPdfRendererWithDefaultStyler(orient, papersz, pdfFile, tracerFile string
 
 // Process takes the markdown content, parses it to generate the PDF
 func (r *PdfRenderer) Process(content []byte) error {
+	return r.process([]InputFile{{Content: content}})
+}
+
+// ProcessFiles takes the content of several markdown files and generates
+// a single PDF. Each file starts on a new page and gets a top-level
+// bookmark, with the bookmarks of its headings nested below it. Links
+// from one file to another, e.g. [setup](./setup.md#linux), jump to the
+// file or to the heading within the PDF.
+func (r *PdfRenderer) ProcessFiles(files []InputFile) error {
+	return r.process(files)
+}
+
+func (r *PdfRenderer) process(files []InputFile) error {
 	// try to open tracer
 	var f *os.File
 	var err error
@@ -316,7 +467,7 @@ func (r *PdfRenderer) Process(content []byte) error {
 		defer r.w.Flush()
 	}
 
-	err = r.Run(content)
+	err = r.run(files)
 	if err != nil {
 		return fmt.Errorf("error on %v:%v", r.pdfFile, err)
 	}
@@ -331,21 +482,66 @@ func (r *PdfRenderer) Process(content []byte) error {
 
 // Run takes the markdown content, parses it but don't generate the PDF. you can access the PDF with youRenderer.Pdf
 func (r *PdfRenderer) Run(content []byte) error {
-	// Preprocess content by changing all CRLF to LF
-	s := content
-	s = markdown.NormalizeNewlines(s)
+	return r.run([]InputFile{{Content: content}})
+}
 
-	if r.unicodeTranslator != nil {
-		s = []byte(r.unicodeTranslator(string(s)))
-	}
+// RunFiles is like ProcessFiles but doesn't generate the PDF.
+func (r *PdfRenderer) RunFiles(files []InputFile) error {
+	return r.run(files)
+}
+
+func (r *PdfRenderer) run(files []InputFile) error {
+	docs := make([]ast.Node, len(files))
+	for i, file := range files {
+		// Preprocess content by changing all CRLF to LF
+		s := file.Content
+		s = markdown.NormalizeNewlines(s)
+
+		if r.unicodeTranslator != nil {
+			s = []byte(r.unicodeTranslator(string(s)))
+		}
 
-	p := parser.NewWithExtensions(r.Extensions)
-	doc := markdown.Parse(s, p)
-	_ = markdown.Render(doc, r)
+		p := parser.NewWithExtensions(r.Extensions)
+		p.Opts.ReadIncludeFn = r.readInclude
+		if r.Extensions&parser.FencedCode != 0 {
+			p.Opts.ParserHook = fencedCodeHook
+		}
+		docs[i] = markdown.Parse(s, p)
+	}
+	r.collectLinkTargets(files, docs)
+	if r.TableOfContents {
+		r.collectContents(docs)
+	}
+	r.bookmarkBase, r.bookmarkLevel = 0, -1
+	for i, doc := range docs {
+		r.file = fileKey(files[i].Name)
+		if r.file != "" {
+			r.startFile(r.file)
+		}
+		_ = markdown.Render(doc, r)
+		r.finishFootnotes()
+	}
+	r.drawContents()
 
 	return nil
 }
 
+// startFile starts a file of a document on a new page, where links to
+// the file jump to, and gives it a top-level bookmark for the bookmarks
+// of its headings to nest below.
+func (r *PdfRenderer) startFile(name string) {
+	r.tracer("File", name)
+	top, _ := r.printableArea()
+	if _, y := r.Pdf.GetXY(); y > top {
+		r.addPage()
+	}
+	r.Pdf.SetLink(r.fileLinks[name], r.Pdf.GetY(), -1)
+	if r.BookmarkDepth > 0 {
+		r.Pdf.Bookmark(strings.TrimSuffix(filepath.Base(name), filepath.Ext(name)), 0, -1)
+		r.bookmarkBase, r.bookmarkLevel = 1, 0
+	}
+}
+
 // UpdateParagraphStyler - update with default styler
 func (r *PdfRenderer) UpdateParagraphStyler(defaultStyler Styler) {
 	initcurrent := &containerState{
@@ -369,9 +565,16 @@ func (r *PdfRenderer) setStyler(s Styler) {
 	// This does not address the root cause
 	// (https://github.com/mandolyte/mdtopdf/issues/18#issuecomment-2179694815)
 	// but it will correct all cases and is safer.
-	if s.Style == "bb" {
-		s.Style = "b"
+	// The same goes for nested emphasis on italic text ("ii"), so
+	// repeated style flags are dropped rather than just "bb".
+	style := ""
+	for _, c := range s.Style {
+		if !strings.ContainsRune(style, c) {
+			style += string(c)
+		}
 	}
+	s.Style = style
+	r.current = s
 	r.Pdf.SetFont(s.Font, s.Style, s.Size)
 	r.Pdf.SetTextColor(s.TextColor.Red, s.TextColor.Green, s.TextColor.Blue)
 	r.Pdf.SetFillColor(s.FillColor.Red, s.FillColor.Green, s.FillColor.Blue)
@@ -390,6 +593,10 @@ func (r *PdfRenderer) writeLink(s Styler, display, url string) {
 	r.Pdf.WriteLinkString(s.Size+s.Spacing, display, url)
 }
 
+func (r *PdfRenderer) writeInternalLink(s Styler, display string, link int) {
+	r.Pdf.WriteLinkID(s.Size+s.Spacing, display, link)
+}
+
 // RenderNode is a default renderer of a single node of a syntax tree. For
 // block nodes it will be called twice: first time with entering=true, second
 // time with entering=false, so that it could know when it's working on an open
@@ -416,32 +623,39 @@ func (r *PdfRenderer) RenderNode(w io.Writer, node ast.Node, entering bool) ast.
 	case *ast.Strong:
 		r.processStrong(node, entering)
 	case *ast.Del:
-		if entering {
-			r.tracer("DEL (entering)", "Not handled")
-		} else {
-			r.tracer("DEL (leaving)", "Not handled")
-		}
+		r.processDel(node, entering)
 	case *ast.HTMLSpan:
 		r.tracer("HTMLSpan", "Not handled")
 	case *ast.Link:
 		r.processLink(*node, entering)
 	case *ast.Image:
-		r.processImage(*node, entering)
+		return r.processImage(node, entering)
 	case *ast.Code:
 		r.processCode(node)
 	case *ast.Document:
 		r.tracer("Document", "Not Handled")
 	case *ast.Paragraph:
+		if r.contents != nil && isContentsMarker(node) {
+			r.processContentsMarker(node, entering)
+			return ast.SkipChildren
+		}
 		r.processParagraph(node, entering)
 	case *ast.BlockQuote:
 		r.processBlockQuote(node, entering)
 	case *ast.HTMLBlock:
 		r.processHTMLBlock(node)
 	case *ast.Heading:
-		r.processHeading(*node, entering)
+		r.processHeading(node, entering)
 	case *ast.HorizontalRule:
 		r.processHorizontalRule(node)
+	case *ast.Footnotes:
+		r.tracer("Footnotes", "")
 	case *ast.List:
+		if node.IsFootnotesList {
+			r.processFootnotesList(node, entering)
+			// the notes have been laid out as a whole
+			return ast.SkipChildren
+		}
 		r.processList(*node, entering)
 	case *ast.ListItem:
 		r.processItem(*node, entering)
@@ -453,10 +667,18 @@ func (r *PdfRenderer) RenderNode(w io.Writer, node ast.Node, entering bool) ast.
 		r.processTableHead(node, entering)
 	case *ast.TableBody:
 		r.processTableBody(node, entering)
+	case *ast.TableFooter:
+		r.processTableFooter(node, entering)
 	case *ast.TableRow:
 		r.processTableRow(node, entering)
 	case *ast.TableCell:
 		r.processTableCell(*node, entering)
+		// the cell content has been laid out as a whole
+		return ast.SkipChildren
+	case *ast.CaptionFigure:
+		r.processCaptionFigure(node, entering)
+	case *ast.Caption:
+		return r.processCaption(node, entering)
 	/*case *ast.Math:
 	r.processMath(node)*/
 	default:
@@ -518,6 +740,156 @@ func IsHorizontalRuleNewPage(value bool) RenderOption {
 	}
 }
 
+// KeepTablesTogether if true, will start a new page before a table that would
+// otherwise break across pages, as long as the table fits on one page.
+// Tables that are longer than a page repeat their header rows on each page.
+func KeepTablesTogether(value bool) RenderOption {
+	return func(r *PdfRenderer) {
+		r.TableKeepTogether = value
+	}
+}
+
+// WithEndnotes if true, will collect footnotes at the end of the document
+// instead of drawing them at the bottom of the page that references them.
+func WithEndnotes(value bool) RenderOption {
+	return func(r *PdfRenderer) {
+		r.Endnotes = value
+	}
+}
+
+// WithTableOfContents if true, will build a table of contents from the
+// headings, with page numbers and links to the headings. The contents
+// are placed at the start of the document, or in place of a paragraph
+// that holds only [TOC].
+func WithTableOfContents(value bool) RenderOption {
+	return func(r *PdfRenderer) {
+		r.TableOfContents = value
+	}
+}
+
+// WithImageCaptions draws a "Figure N" caption under each image, made
+// of its title or else its alt text. Images in a figure with a caption
+// of its own are left alone.
+func WithImageCaptions(captions bool) RenderOption {
+	return func(r *PdfRenderer) {
+		r.ImageCaptions = captions
+	}
+}
+
+// WithFetchPolicy sets how remote images are fetched, e.g. not at all,
+// or only from some hosts.
+func WithFetchPolicy(policy FetchPolicy) RenderOption {
+	return func(r *PdfRenderer) {
+		r.FetchPolicy = policy
+	}
+}
+
+// WithResourceLoader loads images, and included files, with loader
+// rather than from disk and the network.
+func WithResourceLoader(loader ResourceLoader) RenderOption {
+	return func(r *PdfRenderer) {
+		r.ResourceLoader = loader
+	}
+}
+
+// WithImageCache shares cache between renderers, so that the images
+// they have in common are fetched and converted once.
+func WithImageCache(cache *ImageCache) RenderOption {
+	return func(r *PdfRenderer) {
+		r.ImageCache = cache
+	}
+}
+
+// SetImageDPI downsamples images that have many more pixels than they
+// need at the size they are drawn at to dpi pixels per inch. The default,
+// 0, keeps images at full resolution.
+func SetImageDPI(dpi float64) RenderOption {
+	return func(r *PdfRenderer) {
+		r.ImageDPI = dpi
+	}
+}
+
+// SetJPEGQuality sets the quality, from 1 to 100, of JPEG images that are
+// downsampled, and recompresses other JPEG images at that quality if
+// that makes them smaller. The default, 0, recompresses JPEG images only
+// when they are downsampled, at a quality of 85.
+func SetJPEGQuality(quality int) RenderOption {
+	return func(r *PdfRenderer) {
+		r.JPEGQuality = quality
+	}
+}
+
+// SetImageMaxWidth scales images wider than width, in points, down to
+// that width, unless they have a width or height of their own. Images
+// are always scaled down to fit the page.
+func SetImageMaxWidth(width float64) RenderOption {
+	return func(r *PdfRenderer) {
+		r.ImageMaxWidth = width
+	}
+}
+
+// SetBookmarkDepth caps the level of the headings that become bookmarks
+// in the PDF outline; 0 leaves out the bookmarks. The default is 6.
+func SetBookmarkDepth(depth int) RenderOption {
+	return func(r *PdfRenderer) {
+		r.BookmarkDepth = depth
+	}
+}
+
+// SetCaptionPosition draws table and figure captions above or below the
+// table or figure they belong to. The default is CaptionBelow.
+func SetCaptionPosition(position CaptionPosition) RenderOption {
+	return func(r *PdfRenderer) {
+		r.CaptionPosition = position
+	}
+}
+
+// WithCodeFont sets code, inline and in blocks, and its line numbers in
+// the font family, e.g. a monospace TrueType font other than the default
+// Courier. If file is not empty, the TrueType font in file is registered
+// as the family, for each of the styles syntax highlighting may use.
+func WithCodeFont(family, file string) RenderOption {
+	return func(r *PdfRenderer) {
+		if file != "" {
+			// read here, as fpdf takes font files relative to its font
+			// directory
+			data, err := os.ReadFile(file)
+			if err != nil {
+				r.Pdf.SetError(err)
+				return
+			}
+			for _, style := range []string{"", "B", "I", "BI"} {
+				r.Pdf.AddUTF8FontFromBytes(family, style, data)
+			}
+		}
+		r.Code.Font = family
+		r.Backtick.Font = family
+		r.LineNumber.Font = family
+	}
+}
+
+// WithCodeLineNumbers numbers the lines of code blocks, in a gutter to
+// their left. A block may turn its numbers on or off with a linenos
+// attribute, e.g. ```go {linenos=false}, and start them elsewhere with
+// linenostart.
+func WithCodeLineNumbers(numbers bool) RenderOption {
+	return func(r *PdfRenderer) {
+		r.CodeLineNumbers = numbers
+	}
+}
+
+// WithHighlightPalette styles syntax highlighted code blocks with
+// palette when the renderer has the given theme, e.g.
+// WithHighlightPalette(DARK, palette) for a dark palette that leaves the
+// light theme alone.
+func WithHighlightPalette(theme Theme, palette HighlightPalette) RenderOption {
+	return func(r *PdfRenderer) {
+		if r.Theme == theme {
+			r.HighlightPalette = palette
+		}
+	}
+}
+
 // SetSyntaxHighlightBaseDir path to https://github.com/jessp01/gohighlight/tree/master/syntax_files
 func SetSyntaxHighlightBaseDir(path string) RenderOption {
 	return func(r *PdfRenderer) {
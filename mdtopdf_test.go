@@ -20,13 +20,37 @@
 package mdtopdf
 
 import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
 )
 
 func testit(inputf string, gohighlight bool, t *testing.T) {
+	var opts []RenderOption
+	if gohighlight {
+		opts = []RenderOption{IsHorizontalRuleNewPage(true), SetSyntaxHighlightBaseDir("./highlight/syntax_files")}
+	}
+	testitWithExtensions(inputf, 0, opts, t)
+}
+
+// testitWithExtensions is like testit but parses the input with the
+// given parser extensions, e.g. for GFM tables or strikethrough.
+func testitWithExtensions(inputf string, extensions parser.Extensions, opts []RenderOption, t *testing.T) {
 	inputd := "./testdata/"
 	input := path.Join(inputd, inputf)
 
@@ -41,20 +65,40 @@ func testit(inputf string, gohighlight bool, t *testing.T) {
 		t.Errorf("%v:%v", input, err)
 	}
 
-	var r *PdfRenderer
-	var opts []RenderOption
-	if gohighlight {
-		opts := []RenderOption{IsHorizontalRuleNewPage(true), SetSyntaxHighlightBaseDir("./highlight/syntax_files")}
-		r = NewPdfRenderer("", "", pdffile, tracerfile, opts, LIGHT)
-	} else {
-		r = NewPdfRenderer("", "", pdffile, tracerfile, opts, LIGHT)
-	}
+	r := NewPdfRenderer("", "", pdffile, tracerfile, opts, LIGHT)
+	r.Extensions = extensions
 	err = r.Process(content)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
+// testSyntaxDir writes a go syntax file, of the groups the tests use,
+// to a temporary syntax highlighting base directory; the syntax files of
+// highlight/syntax_files are a submodule that may not be checked out.
+// The groups are followed by subgroup, e.g. ".x" for statement.x.
+func testSyntaxDir(t *testing.T, subgroup string) string {
+	t.Helper()
+	dir := t.TempDir()
+	syntax := `filetype: go
+
+detect:
+    filename: "\\.go$"
+
+rules:
+    - statement%[1]v: "\\b(func|return)\\b"
+    - constant.number%[1]v: "\\b[0-9]+\\b"
+    - comment%[1]v:
+        start: "//"
+        end: "$"
+        rules: []
+`
+	if err := os.WriteFile(path.Join(dir, "go.yaml"), []byte(fmt.Sprintf(syntax, subgroup)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
 func TestTables(t *testing.T) {
 	testit("Tables.text", false, t)
 }
@@ -75,6 +119,37 @@ func TestImage(t *testing.T) {
 	testit("Image.text", false, t)
 }
 
+func TestImageSizing(t *testing.T) {
+	opts := []RenderOption{SetImageMaxWidth(300)}
+	testitWithExtensions("Image sizing.text", parser.CommonExtensions|parser.Attributes, opts, t)
+}
+
+func TestImageCaptions(t *testing.T) {
+	opts := []RenderOption{WithImageCaptions(true), SetImageMaxWidth(300)}
+	testitWithExtensions("Image captions.text", parser.CommonExtensions|parser.Mmark|parser.Attributes, opts, t)
+}
+
+func TestSVGImages(t *testing.T) {
+	testitWithExtensions("SVG images.text", parser.CommonExtensions|parser.Attributes, nil, t)
+}
+
+func TestImageFormats(t *testing.T) {
+	testit("Image formats.text", false, t)
+}
+
+func TestDataURIs(t *testing.T) {
+	testit("Data URIs.text", false, t)
+}
+
+func TestImageCompression(t *testing.T) {
+	opts := []RenderOption{SetImageDPI(72), SetJPEGQuality(60)}
+	testitWithExtensions("Image compression.text", parser.CommonExtensions|parser.Attributes, opts, t)
+}
+
+func TestInlineImages(t *testing.T) {
+	testitWithExtensions("Inline images.text", parser.CommonExtensions|parser.AutoHeadingIDs, nil, t)
+}
+
 func TestAutoLinks(t *testing.T) {
 	testit("Auto links.text", false, t)
 }
@@ -111,6 +186,137 @@ func TestCodeBlocks(t *testing.T) {
 	testit("Code Blocks.text", false, t)
 }
 
+func TestCodeLineNumbers(t *testing.T) {
+	opts := []RenderOption{WithCodeLineNumbers(true), SetSyntaxHighlightBaseDir(testSyntaxDir(t, ""))}
+	testitWithExtensions("Code line numbers.text", parser.CommonExtensions, opts, t)
+}
+
+func TestLineSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []int
+	}{
+		{"[3,5-7]", []int{3, 5, 6, 7}},
+		{"3 5-7", []int{3, 5, 6, 7}},
+		{"[ 2 , 4 ]", []int{2, 4}},
+		{"7-5", []int{5, 6, 7}},
+		// lines past the end, and before the first, are left out
+		{"0-2,9-12", []int{1, 2, 9, 10}},
+		{"11", nil},
+		{"abc, 2-x, -3, 4-, 4", []int{4}},
+		{"", nil},
+	}
+	for _, test := range tests {
+		lines := lineSet(test.value, 10)
+		var got []int
+		for n := 1; n <= 10; n++ {
+			if lines[n] {
+				got = append(got, n)
+			}
+		}
+		if len(lines) != len(got) || fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q: got %v, want %v", test.value, lines, test.want)
+		}
+	}
+}
+
+func TestCodeBlockInfo(t *testing.T) {
+	tests := []struct {
+		info  string
+		lang  string
+		attrs map[string]string
+	}{
+		{"go", "go", map[string]string{}},
+		{"go {hl_lines=[3,5-7]}", "go", map[string]string{"hl_lines": "[3,5-7]"}},
+		{"{go linenos=true}", "go", map[string]string{"linenos": "true"}},
+		{`{.go linenostart="10", hl_lines='2 4'}`, "go", map[string]string{"linenostart": "10", "hl_lines": "2 4"}},
+		{"go {HL_Lines=[1]}", "go", map[string]string{"hl_lines": "[1]"}},
+		{"{linenos=false}", "", map[string]string{"linenos": "false"}},
+		{"go {garbage}", "go", map[string]string{}},
+		{"", "", map[string]string{}},
+	}
+	for _, test := range tests {
+		lang, attrs := codeBlockInfo(test.info)
+		if lang != test.lang || fmt.Sprint(attrs) != fmt.Sprint(test.attrs) {
+			t.Errorf("%q: got %q %v, want %q %v", test.info, lang, attrs, test.lang, test.attrs)
+		}
+	}
+}
+
+func TestFencedCodeHook(t *testing.T) {
+	tests := []struct {
+		// the code block the hook takes, if any, and what follows it
+		block, rest string
+		// the info string and literal of the code block
+		info, literal string
+	}{
+		{"```go {hl_lines=[1]}\nx := 1\n```\n", "after", "go {hl_lines=[1]}", "x := 1\n"},
+		{"~~~~go {linenos=true}\n```\n~~~~", "", "go {linenos=true}", "```\n"},
+		// left to the parser: no attributes, no language, no closing
+		// fence, or indented as a code block
+		{"", "```go\nx\n```\n", "", ""},
+		{"", "``` {go}\nx\n```\n", "", ""},
+		{"", "```go {x=1}\nx\n", "", ""},
+		{"", "    ```go {x=1}\nx\n    ```\n", "", ""},
+	}
+	for _, test := range tests {
+		data := test.block + test.rest
+		node, _, consumed := fencedCodeHook([]byte(data))
+		block, _ := node.(*ast.CodeBlock)
+		if consumed != len(test.block) || (block == nil) != (test.block == "") {
+			t.Errorf("%q: got %v, %d bytes, want %d bytes", data, node, consumed, len(test.block))
+			continue
+		}
+		if block != nil && (string(block.Info) != test.info || string(block.Literal) != test.literal) {
+			t.Errorf("%q: got info %q and literal %q, want %q and %q",
+				data, block.Info, block.Literal, test.info, test.literal)
+		}
+	}
+}
+
+func TestCodeWrapping(t *testing.T) {
+	testitWithExtensions("Code wrapping.text", parser.CommonExtensions, nil, t)
+}
+
+func TestHighlightPalette(t *testing.T) {
+	dir := testSyntaxDir(t, "")
+	palette, err := LoadHighlightPalette("./testdata/Highlight palette.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if style, ok := palette.style("constant.number"); !ok || style.TextColor != (Color{0, 0, 200}) {
+		t.Errorf("constant.number has style %v, %v; want that of constant", style, ok)
+	}
+
+	content := []byte("```go\nfunc answer() int { return 42 } // the answer\n```\n")
+	tests := []struct {
+		theme Theme
+		want  []string
+	}{
+		// the palette is set for the light theme
+		{LIGHT, []string{"0.784 0.000 0.000 rg", "0.000 0.000 0.784 rg", "0.502 g", "/Courier-Bold", "/Courier-Oblique"}},
+		// the dark theme keeps its solarized palette
+		{DARK, []string{"0.522 0.600 0.000 rg", "/Courier-Bold"}},
+	}
+	for _, test := range tests {
+		r := NewPdfRenderer("", "", "", "", []RenderOption{SetSyntaxHighlightBaseDir(dir), WithHighlightPalette(LIGHT, palette)}, test.theme)
+		r.Extensions = parser.FencedCode
+		r.Pdf.SetCompression(false)
+		if err := r.Run(content); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := r.Pdf.Output(&buf); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range test.want {
+			if !bytes.Contains(buf.Bytes(), []byte(want)) {
+				t.Errorf("theme %v: the PDF has no %q", test.theme, want)
+			}
+		}
+	}
+}
+
 func TestCodeSpans(t *testing.T) {
 	testit("Code Spans.text", false, t)
 }
@@ -158,3 +364,661 @@ func TestLinksShortcut(t *testing.T) {
 func TestTidyness(t *testing.T) {
 	testit("Tidyness.text", false, t)
 }
+
+func TestStrikethrough(t *testing.T) {
+	testitWithExtensions("Strikethrough.text", parser.CommonExtensions, nil, t)
+}
+
+func TestTableWrapping(t *testing.T) {
+	testitWithExtensions("Table wrapping.text", parser.CommonExtensions, nil, t)
+}
+
+// firstTable parses content with GFM tables and returns its first table.
+func firstTable(t *testing.T, content string) ast.Node {
+	doc := markdown.Parse([]byte(content), parser.NewWithExtensions(parser.CommonExtensions))
+	var table ast.Node
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if _, ok := node.(*ast.Table); ok && table == nil {
+			table = node
+		}
+		return ast.GoToNext
+	})
+	if table == nil {
+		t.Fatal("no table")
+	}
+	return table
+}
+
+// TestTableColumnWidths lays out tables that fit the page, that fit
+// once their long cells wrap, and that are too wide even for their
+// longest words.
+func TestTableColumnWidths(t *testing.T) {
+	long := strings.Repeat("a description that goes on and on ", 12)
+	wide := strings.Repeat("| Internationalization ", 14)
+	tests := []struct {
+		name    string
+		content string
+		// the widths fill the page, and each cell is a single line
+		fills, oneLine bool
+		// the columns that keep room for their longest word
+		keep []int
+	}{
+		{"room", "| Name | Kind |\n|---|---|\n| apple | fruit |\n", false, true, []int{0, 1}},
+		{"tight", "| Name | Description |\n|---|---|\n| apple | " + long + "|\n", true, false, []int{0, 1}},
+		{"overflow", "| a " + wide + "|\n|---" + strings.Repeat("|---", 14) + "|\n| b " + wide + "|\n", true, false, []int{0}},
+	}
+	for _, test := range tests {
+		r := NewPdfRenderer("", "", "", "", nil, LIGHT)
+		table := firstTable(t, test.content)
+		widths := r.tableColumnWidths(table)
+		pagew, _ := r.Pdf.GetPageSize()
+		lm, _, rm, _ := r.Pdf.GetMargins()
+		avail := pagew - lm - rm
+		sum := 0.0
+		for _, w := range widths {
+			sum += w
+		}
+		if sum > avail+1e-6 || test.fills && sum < avail-1e-6 {
+			t.Errorf("%v: the columns take %v of %v", test.name, sum, avail)
+		}
+		margin := r.Pdf.GetCellMargin()
+		for _, row := range tableRows(table) {
+			for col, c := range row.GetChildren() {
+				cell := c.(*ast.TableCell)
+				runs := r.cellRuns(cell)
+				if lines := r.wrapRuns(runs, widths[col]-2*margin); test.oneLine && len(lines) != 1 {
+					t.Errorf("%v: column %d wraps to %d lines", test.name, col, len(lines))
+				}
+				for _, keep := range test.keep {
+					if keep != col {
+						continue
+					}
+					for _, word := range r.splitRuns(runs) {
+						if r.runsWidth(word)+2*margin > widths[col]+1e-6 {
+							t.Errorf("%v: column %d of width %v breaks %q", test.name, col, widths[col], word[0].text)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestWrapRuns wraps text to widths given as the width of other text.
+func TestWrapRuns(t *testing.T) {
+	r := NewPdfRenderer("", "", "", "", nil, LIGHT)
+	bold := r.Normal
+	bold.Style = "b"
+	tests := []struct {
+		runs  []cellRun
+		width string
+		want  []string
+	}{
+		{[]cellRun{{text: "one two three", style: r.Normal}}, "one two three four", []string{"one two three"}},
+		{[]cellRun{{text: "one two three", style: r.Normal}}, "one two", []string{"one two", "three"}},
+		{[]cellRun{{text: "one two three", style: r.Normal}}, "three", []string{"one", "two", "three"}},
+		// a word wider than the line is broken between characters
+		{[]cellRun{{text: "abcdefghij", style: r.Normal}}, "abcde", []string{"abcde", "fghij"}},
+		// a word of runs in two styles stays together
+		{[]cellRun{{text: "bold", style: bold}, {text: ", text", style: r.Normal}}, "bold, te", []string{"bold,", "text"}},
+		{nil, "one", []string{""}},
+	}
+	for _, test := range tests {
+		w := r.runsWidth([]cellRun{{text: test.width, style: r.Normal}})
+		text := ""
+		for _, run := range test.runs {
+			text += run.text
+		}
+		var got []string
+		for _, line := range r.wrapRuns(test.runs, w) {
+			l := ""
+			for _, run := range line {
+				l += run.text
+			}
+			got = append(got, l)
+		}
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%q in the width of %q: got %q, want %q", text, test.width, got, test.want)
+		}
+	}
+}
+
+func TestTableAlignment(t *testing.T) {
+	testitWithExtensions("Table alignment.text", parser.CommonExtensions, nil, t)
+}
+
+func TestTablePageBreaks(t *testing.T) {
+	opts := []RenderOption{KeepTablesTogether(true)}
+	testitWithExtensions("Table page breaks.text", parser.CommonExtensions, opts, t)
+}
+
+func TestTableFormatting(t *testing.T) {
+	testitWithExtensions("Table formatting.text", parser.CommonExtensions, nil, t)
+}
+
+func TestTableFootersAndCaptions(t *testing.T) {
+	testitWithExtensions("Table footers and captions.text", parser.CommonExtensions|parser.Mmark, nil, t)
+}
+
+// TestCaptionRuns checks that emphasis in an italic caption is set
+// upright, and that the caption is italic again after it.
+func TestCaptionRuns(t *testing.T) {
+	content := []byte("| Fruit |\n|-------|\n| apple |\nTable: Fruit *order* for the week\n")
+	doc := parser.NewWithExtensions(parser.CommonExtensions | parser.Mmark).Parse(content)
+	var caption *ast.Caption
+	ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+		if c, ok := node.(*ast.Caption); ok && entering {
+			caption = c
+		}
+		return ast.GoToNext
+	})
+	if caption == nil {
+		t.Fatal("no caption")
+	}
+	r := NewPdfRenderer("", "", "", "", nil, LIGHT)
+	want := []struct{ text, style string }{{"Fruit ", "i"}, {"order", ""}, {" for the week", "i"}}
+	runs := r.inlineRuns(caption, r.Caption)
+	if len(runs) != len(want) {
+		t.Fatalf("got %d runs, want %d", len(runs), len(want))
+	}
+	for i, run := range runs {
+		if run.text != want[i].text || run.style.Style != want[i].style {
+			t.Errorf("run %d is %q in style %q, want %q in style %q",
+				i, run.text, run.style.Style, want[i].text, want[i].style)
+		}
+	}
+}
+
+func TestCaptionsAbove(t *testing.T) {
+	opts := []RenderOption{SetCaptionPosition(CaptionAbove)}
+	testitWithExtensions("Table captions above.text", parser.CommonExtensions|parser.Mmark, opts, t)
+}
+
+func TestFootnotes(t *testing.T) {
+	testitWithExtensions("Footnotes.text", parser.CommonExtensions|parser.Footnotes, nil, t)
+}
+
+func TestEndnotes(t *testing.T) {
+	opts := []RenderOption{WithEndnotes(true)}
+	testitWithExtensions("Endnotes.text", parser.CommonExtensions|parser.Footnotes, opts, t)
+}
+
+func TestTableOfContents(t *testing.T) {
+	opts := []RenderOption{WithTableOfContents(true)}
+	testitWithExtensions("Table of contents.text", parser.CommonExtensions, opts, t)
+}
+
+func TestTableOfContentsMarker(t *testing.T) {
+	opts := []RenderOption{WithTableOfContents(true)}
+	testitWithExtensions("Table of contents marker.text", parser.CommonExtensions, opts, t)
+}
+
+// TestContentsPages renders a long document with a table of contents
+// of more than one page, at the start and at a [TOC] marker, and checks
+// that each entry gives the page its heading is drawn on.
+func TestContentsPages(t *testing.T) {
+	var body bytes.Buffer
+	for i := 1; i <= 80; i++ {
+		fmt.Fprintf(&body, "## Section %d\n\n%v\n\n", i, strings.Repeat("Some text to fill the page. ", 25*(i%4)))
+	}
+	// an entry: its heading text, then dot leaders and the page number
+	entry := regexp.MustCompile(`(?s)\((Section \d+)\)Tj.*?\(\.+\)Tj ET Q\s+q [^(]*\((\d+)\)Tj`)
+	tests := []struct {
+		name, before string
+	}{
+		{"at the start", ""},
+		{"at a marker", "# Introduction\n\nThe contents follow.\n\n[TOC]\n\n"},
+	}
+	for _, test := range tests {
+		r := NewPdfRenderer("", "", "", "", []RenderOption{WithTableOfContents(true)}, LIGHT)
+		r.Extensions = parser.CommonExtensions
+		r.Pdf.SetCompression(false)
+		if err := r.Run(append([]byte(test.before), body.Bytes()...)); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := r.Pdf.Output(&buf); err != nil {
+			t.Fatal(err)
+		}
+		// fpdf writes each page followed by its content
+		pages := strings.Split(buf.String(), "<</Type /Page\n")[1:]
+		printed := map[string]string{}
+		drawn := map[string]string{}
+		contentsPages := 0
+		for i, page := range pages {
+			entries := entry.FindAllStringSubmatch(page, -1)
+			if len(entries) > 0 {
+				contentsPages++
+				for _, e := range entries {
+					printed[e[1]] = e[2]
+				}
+				continue
+			}
+			for n := 1; n <= 80; n++ {
+				heading := fmt.Sprintf("Section %d", n)
+				if strings.Contains(page, "("+heading+")Tj") {
+					drawn[heading] = strconv.Itoa(i + 1)
+				}
+			}
+		}
+		if contentsPages < 2 {
+			t.Errorf("%v: the contents take %d pages, want more than one", test.name, contentsPages)
+		}
+		for n := 1; n <= 80; n++ {
+			heading := fmt.Sprintf("Section %d", n)
+			if printed[heading] == "" || printed[heading] != drawn[heading] {
+				t.Errorf("%v: the contents give page %q for %v, which is on page %q",
+					test.name, printed[heading], heading, drawn[heading])
+			}
+		}
+	}
+}
+
+// collectHeadings parses files as Run does and gives their headings
+// link targets; it returns the headings in order.
+func collectHeadings(r *PdfRenderer, files []InputFile) []*ast.Heading {
+	var docs []ast.Node
+	var headings []*ast.Heading
+	for _, file := range files {
+		doc := markdown.Parse(file.Content, parser.NewWithExtensions(r.Extensions))
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if heading, ok := node.(*ast.Heading); ok && entering {
+				headings = append(headings, heading)
+			}
+			return ast.GoToNext
+		})
+		docs = append(docs, doc)
+	}
+	r.collectLinkTargets(files, docs)
+	return headings
+}
+
+// TestHeadingLinks resolves #ID links to the headings of a document.
+// Headings are numbered from 0; -1 is no heading.
+func TestHeadingLinks(t *testing.T) {
+	content := "# Intro\n\n## Setup\n\n## Setup\n\n## First {#same}\n\n## Second {#same}\n"
+	r := NewPdfRenderer("", "", "", "", nil, LIGHT)
+	r.Extensions = parser.CommonExtensions | parser.AutoHeadingIDs
+	headings := collectHeadings(r, []InputFile{{Content: []byte(content)}})
+	tests := []struct {
+		destination string
+		heading     int
+		url         string
+		missing     bool
+	}{
+		{"#intro", 0, "", false},
+		// headings of the same text have IDs of their own
+		{"#setup", 1, "", false},
+		{"#setup-1", 2, "", false},
+		// of headings with the same ID, the first one is the target
+		{"#same", 3, "", false},
+		{"#nowhere", -1, "", true},
+		{"https://example.com/#intro", -1, "https://example.com/#intro", false},
+	}
+	for _, test := range tests {
+		url, link := r.resolveLink(test.destination)
+		want := 0
+		if test.heading >= 0 {
+			want = r.headingLinks[headings[test.heading]]
+		}
+		if link != want || url != test.url {
+			t.Errorf("%v: got link %v and URL %q, want link %v and URL %q",
+				test.destination, link, url, want, test.url)
+		}
+		if missing := r.missingAnchors[anchorKey("", test.destination[1:])]; test.destination[0] == '#' && missing != test.missing {
+			t.Errorf("%v: missing anchor is %v, want %v", test.destination, missing, test.missing)
+		}
+	}
+}
+
+// TestLinksBetweenFileTargets resolves links between the files of a
+// document, from each of the files. Headings are numbered from 0; -1 is
+// the start of the file.
+func TestLinksBetweenFileTargets(t *testing.T) {
+	files := []InputFile{
+		{Name: "home.md", Content: []byte("# Welcome\n\n## Contents\n")},
+		{Name: "guide/setup.md", Content: []byte("# Setup\n\n## Install\n")},
+	}
+	r := NewPdfRenderer("", "", "", "", nil, LIGHT)
+	r.Extensions = parser.CommonExtensions | parser.AutoHeadingIDs
+	headings := collectHeadings(r, files)
+	tests := []struct {
+		from, destination string
+		file              string
+		heading           int
+		url               string
+	}{
+		{"home.md", "guide/setup.md#install", "guide/setup.md", 3, ""},
+		{"home.md", "./guide/setup.md", "guide/setup.md", -1, ""},
+		{"home.md", "#contents", "home.md", 1, ""},
+		// a missing heading jumps to the start of its file
+		{"home.md", "guide/setup.md#nowhere", "guide/setup.md", -1, ""},
+		{"guide/setup.md", "../home.md#welcome", "home.md", 0, ""},
+		{"guide/setup.md", "/home.md", "home.md", -1, ""},
+		// files that aren't part of the document stay URLs
+		{"home.md", "other.md#section", "", -1, "other.md#section"},
+		{"guide/setup.md", "install.md", "", -1, "install.md"},
+		{"home.md", "https://example.com/home.md", "", -1, "https://example.com/home.md"},
+	}
+	for _, test := range tests {
+		r.file = test.from
+		url, link := r.resolveLink(test.destination)
+		want := 0
+		switch {
+		case test.heading >= 0:
+			want = r.headingLinks[headings[test.heading]]
+		case test.file != "":
+			want = r.fileLinks[test.file]
+		}
+		if link != want || url != test.url {
+			t.Errorf("%v from %v: got link %v and URL %q, want link %v and URL %q",
+				test.destination, test.from, link, url, want, test.url)
+		}
+	}
+}
+
+func TestBookmarks(t *testing.T) {
+	opts := []RenderOption{SetBookmarkDepth(3)}
+	testitWithExtensions("Bookmarks.text", parser.CommonExtensions, opts, t)
+}
+
+func TestHeadingAnchors(t *testing.T) {
+	testitWithExtensions("Heading anchors.text", parser.CommonExtensions|parser.AutoHeadingIDs, nil, t)
+}
+
+// TestProcessFiles renders several files into one PDF, each with a
+// top-level bookmark.
+func TestProcessFiles(t *testing.T) {
+	var files []InputFile
+	for _, name := range []string{"Bookmarks.text", "Table of contents.text"} {
+		content, err := os.ReadFile(path.Join("./testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, InputFile{Name: name, Content: content})
+	}
+	r := NewPdfRenderer("", "", "./testdata/Multiple files.pdf", "./testdata/Multiple files.log",
+		[]RenderOption{WithTableOfContents(true)}, LIGHT)
+	r.Extensions = parser.CommonExtensions
+	if err := r.ProcessFiles(files); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestLinksBetweenFiles renders files that link to each other, and
+// names them as they would be named in a directory of markdown files.
+func TestLinksBetweenFiles(t *testing.T) {
+	var files []InputFile
+	for _, f := range [][2]string{{"home.md", "Wiki home.text"}, {"guide/setup.md", "Wiki setup.text"}} {
+		content, err := os.ReadFile(path.Join("./testdata", f[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, InputFile{Name: f[0], Content: content})
+	}
+	r := NewPdfRenderer("", "", "./testdata/Wiki.pdf", "./testdata/Wiki.log", nil, LIGHT)
+	r.Extensions = parser.CommonExtensions | parser.AutoHeadingIDs
+	if err := r.ProcessFiles(files); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestResourceLoader loads the images and included files of a document
+// from a file system in memory.
+func TestResourceLoader(t *testing.T) {
+	logo, err := os.ReadFile("./image/fpdf.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"assets/logo.png": {Data: logo},
+		"chapters/intro.md": {Data: []byte("## Included chapter\n\n" +
+			"This chapter is included from chapters/intro.md; its image is\n" +
+			"looked up relative to the root of the file system.\n\n" +
+			"![The fpdf logo again](/assets/logo.png)\n")},
+		"chapters/hello.go": {Data: []byte("package main\n\nimport \"fmt\"\n\n" +
+			"func main() {\n\tfmt.Println(\"hello\")\n}\n")},
+	}
+	opts := []RenderOption{WithResourceLoader(FSLoader(fsys))}
+	testitWithExtensions("Resource loader.text", parser.CommonExtensions|parser.Includes, opts, t)
+}
+
+// TestImageCache renders documents that use the same remote image many
+// times, under different names, with renderers that share an image
+// cache.
+func TestImageCache(t *testing.T) {
+	photo, err := os.ReadFile("./image/bay.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write(photo)
+	}))
+	defer server.Close()
+
+	content := []byte(fmt.Sprintf("![bay](%[1]v/bay.jpg)\n\n![bay](%[1]v/bay.jpg)\n\n"+
+		"![bay](%[1]v/other/bay.jpg)\n\n![bay](./image/bay.jpg)\n", server.URL))
+	cache := NewImageCache()
+	for i := 0; i < 2; i++ {
+		r := NewPdfRenderer("", "", "", "", []RenderOption{WithImageCache(cache)}, LIGHT)
+		r.Pdf.SetCompression(false)
+		if err := r.Run(content); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := r.Pdf.Output(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if n := bytes.Count(buf.Bytes(), []byte("/Subtype /Image")); n != 1 {
+			t.Errorf("render %d: the image is embedded %d times", i, n)
+		}
+	}
+	// once for each URL
+	if fetches != 2 {
+		t.Errorf("the image was fetched %d times", fetches)
+	}
+}
+
+// TestImageCacheConcurrent renders a document with a remote image with
+// many renderers at once, which share an image cache and fetch the image
+// once between them.
+func TestImageCacheConcurrent(t *testing.T) {
+	photo, err := os.ReadFile("./image/bay.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write(photo)
+	}))
+	defer server.Close()
+
+	content := []byte(fmt.Sprintf("![bay](%v/bay.jpg)\n", server.URL))
+	cache := NewImageCache()
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := NewPdfRenderer("", "", "", "", []RenderOption{WithImageCache(cache)}, LIGHT)
+			if err := r.Run(content); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if fetches != 1 {
+		t.Errorf("the image was fetched %d times", fetches)
+	}
+}
+
+// TestImageCachePolicy shares an image cache between renderers that may
+// not load the same images: an image one renderer fetched isn't given to
+// an offline renderer, or to one with a ResourceLoader of its own.
+func TestImageCachePolicy(t *testing.T) {
+	photo, err := os.ReadFile("./image/bay.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logo, err := os.ReadFile("./image/fpdf.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(photo)
+	}))
+	defer server.Close()
+
+	content := []byte(fmt.Sprintf("![bay](%v/bay.jpg)\n", server.URL))
+	cache := NewImageCache()
+	render := func(opts ...RenderOption) []byte {
+		r := NewPdfRenderer("", "", "", "", append(opts, WithImageCache(cache)), LIGHT)
+		r.Pdf.SetCompression(false)
+		if err := r.Run(content); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := r.Pdf.Output(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	if pdf := render(); !bytes.Contains(pdf, []byte("/Filter /DCTDecode")) {
+		t.Error("the online renderer didn't embed the image")
+	}
+	if pdf := render(WithFetchPolicy(FetchPolicy{Offline: true})); bytes.Contains(pdf, []byte("/Subtype /Image")) {
+		t.Error("the offline renderer embedded the image")
+	}
+	loader := ResourceLoaderFunc(func(name string) ([]byte, error) {
+		return logo, nil
+	})
+	pdf := render(WithResourceLoader(loader))
+	if bytes.Contains(pdf, []byte("/Filter /DCTDecode")) || !bytes.Contains(pdf, []byte("/Subtype /Image")) {
+		t.Error("the renderer with a ResourceLoader didn't embed the image of its loader")
+	}
+}
+
+// TestFetchPolicy fetches from a local server under the controls of a
+// FetchPolicy.
+func TestFetchPolicy(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image", func(w http.ResponseWriter, req *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	mux.HandleFunc("/away", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "http://example.com/image", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/loop", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		policy FetchPolicy
+		path   string
+		fail   bool
+	}{
+		{"default", FetchPolicy{}, "/image", false},
+		{"offline", FetchPolicy{Offline: true}, "/image", true},
+		{"allowed host", FetchPolicy{AllowedHosts: []string{"127.0.0.1"}}, "/image", false},
+		{"other host", FetchPolicy{AllowedHosts: []string{"example.com"}}, "/image", true},
+		{"redirect to other host", FetchPolicy{AllowedHosts: []string{"127.0.0.1"}}, "/away", true},
+		{"redirect loop", FetchPolicy{}, "/loop", true},
+		{"timeout", FetchPolicy{Timeout: 50 * time.Millisecond}, "/slow", true},
+		{"at size limit", FetchPolicy{MaxSize: 100}, "/image", false},
+		{"over size limit", FetchPolicy{MaxSize: 99}, "/image", true},
+	}
+	for _, test := range tests {
+		_, err := test.policy.Fetch(server.URL + test.path)
+		if (err != nil) != test.fail {
+			t.Errorf("%v: got error %v", test.name, err)
+		}
+	}
+	if _, err := (FetchPolicy{}).Fetch("file:///etc/passwd"); err == nil {
+		t.Error("fetched a file URL")
+	}
+}
+
+// syntaxGroups numbers the groups TestConcurrentRenderers adds to
+// gohighlight.
+var syntaxGroups int
+
+// TestConcurrentRenderers renders the same documents with many renderers
+// at once; run with -race to check that the state renderers share, the
+// syntax highlighting groups, is locked.
+func TestConcurrentRenderers(t *testing.T) {
+	// syntax highlighted code, of a group new to gohighlight for each
+	// renderer, so that renderers add groups while others look them up
+	inputs := [][]byte{[]byte("```go\nfunc answer() int {\n\treturn 42 // the answer\n}\n```\n")}
+	for _, f := range []string{"Table page breaks.text", "Table formatting.text", "Table footers and captions.text"} {
+		content, err := os.ReadFile(path.Join("./testdata/", f))
+		if err != nil {
+			t.Fatalf("%v:%v", f, err)
+		}
+		inputs = append(inputs, content)
+	}
+	// the syntax files are written up front, as t.TempDir orders the
+	// goroutines that call it
+	syntaxDir := func() string {
+		syntaxGroups++
+		return testSyntaxDir(t, fmt.Sprintf(".concurrent%d", syntaxGroups))
+	}
+	render := func(content []byte, dir string) ([]byte, error) {
+		r := NewPdfRenderer("", "", "", "", []RenderOption{SetSyntaxHighlightBaseDir(dir)}, LIGHT)
+		r.Extensions = parser.CommonExtensions | parser.Mmark
+		r.Pdf.SetCatalogSort(true)
+		r.Pdf.SetCreationDate(time.Unix(0, 0))
+		r.Pdf.SetModificationDate(time.Unix(0, 0))
+		if err := r.Run(content); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err := r.Pdf.Output(&buf)
+		return buf.Bytes(), err
+	}
+
+	var want [][]byte
+	for _, content := range inputs {
+		pdf, err := render(content, syntaxDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, pdf)
+	}
+
+	// the renderers start together, so that they overlap
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*len(inputs))
+	for n := 0; n < 8; n++ {
+		for i, content := range inputs {
+			wg.Add(1)
+			go func(i int, content []byte, dir string) {
+				defer wg.Done()
+				<-start
+				pdf, err := render(content, dir)
+				if err == nil && !bytes.Equal(pdf, want[i]) {
+					err = fmt.Errorf("input %d: concurrent output differs from sequential output", i)
+				}
+				if err != nil {
+					errs <- err
+				}
+			}(i, content, syntaxDir())
+		}
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
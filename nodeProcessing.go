@@ -20,26 +20,35 @@
 package mdtopdf
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"io"
+	"image"
 	"log"
-	"net/http"
+	"math"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 
 	// "reflect"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
-	"github.com/canhlinh/svg2png"
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/go-pdf/fpdf"
 	"github.com/gomarkdown/markdown/ast"
 	highlight "github.com/jessp01/gohighlight"
 )
 
+// gohighlight adds the groups of every syntax definition it parses to its
+// package-level Groups map, so parsing a definition and looking up groups
+// are serialised across renderers.
+var highlightGroups sync.RWMutex
+
 func (r *PdfRenderer) processText(node *ast.Text) {
 	currentStyle := r.cs.peek().textStyle
 	r.setStyler(currentStyle)
@@ -52,37 +61,18 @@ func (r *PdfRenderer) processText(node *ast.Text) {
 	switch node.Parent.(type) {
 
 	case *ast.Link:
-		r.writeLink(currentStyle, s, r.cs.peek().destination)
+		link := r.cs.peek()
+		switch {
+		case link.anchor != 0:
+			r.writeInternalLink(currentStyle, s, link.anchor)
+		case link.destination == "":
+			// e.g. a link to a missing anchor
+			r.write(currentStyle, s)
+		default:
+			r.writeLink(currentStyle, s, link.destination)
+		}
 	case *ast.Heading:
 		r.write(currentStyle, s)
-	case *ast.TableCell:
-		if r.cs.peek().isHeader {
-			r.setStyler(currentStyle)
-			// get the string width of header value
-			initialWidth := r.Pdf.GetStringWidth(s)
-			/* if initialWidth == 0 {
-			    initialWidth = 30
-			}
-			log.Println(s + ":")
-			log.Println(initialWidth)*/
-			hw := initialWidth + (2 * r.em)
-			// now append it
-			cellwidths = append(cellwidths, hw)
-			// now write it...
-			h, _ := r.Pdf.GetFontSize()
-			h += currentStyle.Spacing
-			r.tracer("... table header cell",
-				fmt.Sprintf("Width=%v, height=%v", hw, h))
-
-			r.Pdf.CellFormat(hw, h, s, "1", 0, "C", true, 0, "")
-		} else {
-			r.setStyler(currentStyle)
-			hw := cellwidths[curdatacell]
-			h := currentStyle.Size + currentStyle.Spacing
-			r.tracer("... table body cell",
-				fmt.Sprintf("Width=%v, height=%v", hw, h))
-			r.Pdf.CellFormat(hw, h, s, "LR", 0, "", fill, 0, "")
-		}
 	case *ast.BlockQuote:
 		if r.NeedBlockquoteStyleUpdate {
 			r.tracer("Text BlockQuote", s)
@@ -100,10 +90,159 @@ func (r *PdfRenderer) processMath(node *ast.Math) {
 	r.write(currentStyle, s)
 }
 
-func (r *PdfRenderer) outputUnhighlightedCodeBlock(codeBlock string) {
+// writeCodeBlock writes the lines of a code block in the Backtick
+// style, coloured by the syntax highlighting matches if there are any;
+// code that isn't highlighted is set on the fill colour of the style.
+// Tabs are expanded to tab stops every codeTabWidth columns, and lines
+// too long for the page are wrapped, with a continuation marker at the
+// end of each broken row.
+func (r *PdfRenderer) writeCodeBlock(literal string, matches []highlight.LineMatch, layout codeBlockLayout) {
 	r.cr() // start on next line!
-	r.setStyler(r.Backtick)
-	r.multiCell(r.Backtick, codeBlock)
+	base := r.Backtick
+	r.setStyler(base)
+	lh := base.Size + base.Spacing
+	fill := matches == nil
+	pagew, _ := r.Pdf.GetPageSize()
+	_, _, rm, _ := r.Pdf.GetMargins()
+	// fpdf sets text a cell margin into its cell; the marker goes in
+	// the space kept free at the right
+	right := pagew - rm - r.em - 2*r.Pdf.GetCellMargin()
+	for lineN, line := range strings.Split(strings.TrimSuffix(literal, "\n"), "\n") {
+		r.startCodeRow(layout, lineN+1, lh, true, fill)
+		x := r.Pdf.GetX()
+		var run strings.Builder
+		flush := func() {
+			if run.Len() > 0 {
+				r.Pdf.Write(lh, run.String())
+				run.Reset()
+			}
+		}
+		col, rows := 0, 1
+		for colN, c := range []rune(line) {
+			if lineN < len(matches) {
+				if group, ok := matches[lineN][colN]; ok {
+					flush()
+					r.setStyler(r.highlightStyler(base, group.String()))
+				}
+			}
+			text := string(c)
+			if c == '\t' {
+				text = strings.Repeat(" ", codeTabWidth-col%codeTabWidth)
+			}
+			for _, ch := range text {
+				w := r.Pdf.GetStringWidth(string(ch))
+				if x+w > right && x > layout.left+layout.gutter {
+					flush()
+					r.drawContinuationMarker(pagew-rm-r.em, r.Pdf.GetY(), lh)
+					r.Pdf.Ln(lh)
+					r.startCodeRow(layout, lineN+1, lh, false, fill)
+					x = r.Pdf.GetX()
+					rows++
+				}
+				run.WriteRune(ch)
+				x += w
+				col++
+			}
+		}
+		flush()
+		r.Pdf.Ln(lh)
+		if rows > 1 {
+			r.tracer("Codeblock (wrapped)", fmt.Sprintf("line %v in %v rows", lineN+1, rows))
+		}
+	}
+}
+
+// drawContinuationMarker draws a return arrow, as ↵, in the space of
+// width em at x, on the row of code of height h at y, to show that the
+// line goes on on the next row.
+func (r *PdfRenderer) drawContinuationMarker(x, y, h float64) {
+	red, green, blue := r.Pdf.GetDrawColor()
+	width := r.Pdf.GetLineWidth()
+	color := r.LineNumber.TextColor
+	r.Pdf.SetDrawColor(color.Red, color.Green, color.Blue)
+	r.Pdf.SetLineWidth(0.6)
+	size := r.em * 0.6
+	left, right := x+(r.em-size)/2, x+(r.em+size)/2
+	// on the middle of the text, which is a little below that of the row
+	top, mid := y+h/2-size/2, y+h/2+size/4
+	r.Pdf.Line(right, top, right, mid)
+	r.Pdf.Line(right, mid, left, mid)
+	r.Pdf.Line(left, mid, left+size/3, mid-size/3)
+	r.Pdf.Line(left, mid, left+size/3, mid+size/3)
+	r.Pdf.SetDrawColor(red, green, blue)
+	r.Pdf.SetLineWidth(width)
+}
+
+// highlightStyler returns the style of the tokens of a highlighting
+// group in a code block of style s, from the HighlightPalette.
+func (r *PdfRenderer) highlightStyler(s Styler, group string) Styler {
+	if style, ok := r.HighlightPalette.style(group); ok {
+		s.TextColor = style.TextColor
+		s.Style = style.Style
+	}
+	return s
+}
+
+// codeBlockLayout returns the gutter and shading of a code block of
+// literal, from the hl_lines, linenos and linenostart attributes of its
+// info string. Lines are numbered if CodeLineNumbers is set, unless
+// linenos is false, or if linenos is set.
+func (r *PdfRenderer) codeBlockLayout(attrs map[string]string, literal string) codeBlockLayout {
+	count := strings.Count(strings.TrimSuffix(literal, "\n"), "\n") + 1
+	layout := codeBlockLayout{numbered: r.CodeLineNumbers, firstLine: 1}
+	layout.left, _, _, _ = r.Pdf.GetMargins()
+	if value, ok := attrs["linenos"]; ok {
+		layout.numbered = value != "false"
+	}
+	if n, err := strconv.Atoi(attrs["linenostart"]); err == nil {
+		layout.firstLine = n
+	}
+	if value, ok := attrs["hl_lines"]; ok {
+		layout.highlight = lineSet(value, count)
+	}
+	if layout.numbered {
+		prev := r.current
+		r.setStyler(r.LineNumber)
+		widest := strconv.Itoa(layout.firstLine + count - 1)
+		if first := strconv.Itoa(layout.firstLine); len(first) > len(widest) {
+			widest = first
+		}
+		layout.gutter = r.Pdf.GetStringWidth(widest) + 2*r.em
+		r.setStyler(prev)
+	}
+	return layout
+}
+
+// startCodeRow starts a row, h high, of line n of a code block on the
+// page: it shades the row if the line is one of the highlighted lines,
+// or if fill is set, and sets the number of the line in the gutter on
+// its first row. It leaves the position at the start of the code, and
+// the style as it was.
+func (r *PdfRenderer) startCodeRow(layout codeBlockLayout, n int, h float64, first, fill bool) {
+	prev := r.current
+	if _, bottom := r.printableArea(); r.Pdf.GetY()+h > bottom {
+		r.addPage()
+	}
+	y := r.Pdf.GetY()
+	x := layout.left + layout.gutter
+	color := r.Backtick.FillColor
+	if layout.highlight[n] {
+		color, fill = r.CodeHighlightColor, true
+	}
+	if fill {
+		pagew, _ := r.Pdf.GetPageSize()
+		_, _, rm, _ := r.Pdf.GetMargins()
+		r.Pdf.SetFillColor(color.Red, color.Green, color.Blue)
+		r.Pdf.Rect(x, y, pagew-rm-x, h, "F")
+	}
+	if first && layout.numbered {
+		r.setStyler(r.LineNumber)
+		// on the baseline of the code
+		r.Pdf.SetXY(layout.left, y+0.3*(prev.Size-r.LineNumber.Size))
+		r.Pdf.CellFormat(layout.gutter-r.em, h, strconv.Itoa(layout.firstLine+n-1), "", 0, "R", false, 0, "")
+	}
+	r.setStyler(prev)
+	r.Pdf.SetXY(x, y)
 }
 
 func (r *PdfRenderer) processCodeblock(node ast.CodeBlock) {
@@ -112,102 +251,39 @@ func (r *PdfRenderer) processCodeblock(node ast.CodeBlock) {
 	currentStyle := r.cs.peek().textStyle
 	r.setStyler(currentStyle)
 
+	lang, attrs := codeBlockInfo(string(node.Info))
+	layout := r.codeBlockLayout(attrs, string(node.Literal))
+	if layout.numbered || len(layout.highlight) > 0 {
+		r.tracer("Codeblock (layout)", fmt.Sprintf("numbered=%v, first line=%v, highlighted=%v",
+			layout.numbered, layout.firstLine, len(layout.highlight)))
+	}
+
 	var isValidSyntaxHighlightBaseDir bool = false
 	if stat, err := os.Stat(r.SyntaxHighlightBaseDir); err == nil && stat.IsDir() {
 		isValidSyntaxHighlightBaseDir = true
 	}
 
-	if len(node.Info) < 1 || !isValidSyntaxHighlightBaseDir {
-		r.outputUnhighlightedCodeBlock(string(node.Literal))
+	if lang == "" || !isValidSyntaxHighlightBaseDir {
+		r.writeCodeBlock(string(node.Literal), nil, layout)
 		return
 	}
 
-	if strings.HasPrefix(string(node.Literal), "<script") && string(node.Info) == "html" {
-		node.Info = []byte("javascript")
+	if strings.HasPrefix(string(node.Literal), "<script") && lang == "html" {
+		lang = "javascript"
 	}
-	syntaxFile, lerr := os.ReadFile(r.SyntaxHighlightBaseDir + "/" + string(node.Info) + ".yaml")
+	syntaxFile, lerr := os.ReadFile(r.SyntaxHighlightBaseDir + "/" + lang + ".yaml")
 	if lerr != nil {
-		r.outputUnhighlightedCodeBlock(string(node.Literal))
+		r.writeCodeBlock(string(node.Literal), nil, layout)
 		return
 	}
+	highlightGroups.Lock()
 	syntaxDef, _ := highlight.ParseDef(syntaxFile)
+	highlightGroups.Unlock()
 	h := highlight.NewHighlighter(syntaxDef)
 	matches := h.HighlightString(string(node.Literal))
-	r.cr()
-	lines := strings.Split(string(node.Literal), "\n")
-	for lineN, l := range lines {
-		colN := 0
-		for _, c := range l {
-			if group, ok := matches[lineN][colN]; ok {
-				switch group {
-				case highlight.Groups["default"]:
-					fallthrough
-				case highlight.Groups[""]:
-					r.setStyler(r.Normal)
-				case highlight.Groups["statement"]:
-					fallthrough
-				case highlight.Groups["green"]:
-					r.Pdf.SetTextColor(42, 170, 138)
-				case highlight.Groups["identifier"]:
-					fallthrough
-				case highlight.Groups["blue"]:
-					r.Pdf.SetTextColor(137, 207, 240)
-
-				case highlight.Groups["preproc"]:
-					r.Pdf.SetTextColor(255, 80, 80)
-
-				case highlight.Groups["special"]:
-					fallthrough
-				case highlight.Groups["type.keyword"]:
-					fallthrough
-				case highlight.Groups["red"]:
-					r.Pdf.SetTextColor(255, 80, 80)
-
-				case highlight.Groups["constant"]:
-					fallthrough
-				case highlight.Groups["constant.number"]:
-					fallthrough
-				case highlight.Groups["constant.bool"]:
-					fallthrough
-				case highlight.Groups["symbol.brackets"]:
-					fallthrough
-				case highlight.Groups["identifier.var"]:
-					fallthrough
-				case highlight.Groups["cyan"]:
-					r.Pdf.SetTextColor(0, 136, 163)
-
-				case highlight.Groups["constant.specialChar"]:
-					fallthrough
-				case highlight.Groups["constant.string.url"]:
-					fallthrough
-				case highlight.Groups["constant.string"]:
-					fallthrough
-				case highlight.Groups["magenta"]:
-					r.Pdf.SetTextColor(255, 0, 255)
-
-				case highlight.Groups["type"]:
-					fallthrough
-				case highlight.Groups["symbol.operator"]:
-					fallthrough
-				case highlight.Groups["symbol.tag.extended"]:
-					fallthrough
-				case highlight.Groups["yellow"]:
-					r.Pdf.SetTextColor(255, 165, 0)
-
-				case highlight.Groups["comment"]:
-					fallthrough
-				case highlight.Groups["high.green"]:
-					r.Pdf.SetTextColor(82, 204, 0)
-				default:
-					r.setStyler(r.Normal)
-				}
-			}
-			r.Pdf.Write(5, string(c))
-			colN++
-		}
-
-		r.cr()
-	}
+	highlightGroups.RLock()
+	defer highlightGroups.RUnlock()
+	r.writeCodeBlock(string(node.Literal), matches, layout)
 }
 
 func (r *PdfRenderer) processList(node ast.List, entering bool) {
@@ -309,16 +385,139 @@ func (r *PdfRenderer) processStrong(node ast.Node, entering bool) {
 	}
 }
 
-func (r *PdfRenderer) processLink(node ast.Link, entering bool) {
-	destination := string(node.Destination)
+// processDel uses the fpdf strike-out font style ("S"), so the line
+// follows the current text colour, font size and baseline, including
+// when the text wraps or is drawn inside a table cell.
+func (r *PdfRenderer) processDel(node ast.Node, entering bool) {
 	if entering {
-		if r.InputBaseURL != "" && !strings.HasPrefix(destination, "http") {
-			destination = r.InputBaseURL + "/" + strings.Replace(destination, "./", "", 1)
+		r.tracer("Del (entering)", "")
+		r.cs.peek().textStyle.Style += "s"
+	} else {
+		r.tracer("Del (leaving)", "")
+		r.cs.peek().textStyle.Style = strings.ReplaceAll(
+			r.cs.peek().textStyle.Style, "s", "")
+	}
+}
+
+// linkDestination resolves a relative link destination against the
+// base URL of a remote input file.
+func (r *PdfRenderer) linkDestination(destination string) string {
+	if r.InputBaseURL != "" && !strings.HasPrefix(destination, "http") {
+		destination = r.InputBaseURL + "/" + strings.Replace(destination, "./", "", 1)
+	}
+	return destination
+}
+
+// resolveLink returns the fpdf internal link for a destination inside
+// the document, and the URL for any other destination. A destination
+// inside the document is a #ID in the same file, or the path of another
+// file of the document, relative to the linking file, with an optional
+// #ID. A link to an ID that no heading of the file has jumps to the
+// start of the file, if that is another file, or nowhere.
+func (r *PdfRenderer) resolveLink(destination string) (string, int) {
+	file, id, ok := r.linkTarget(destination)
+	if !ok {
+		return r.linkDestination(destination), 0
+	}
+	if id == "" {
+		return "", r.fileLinks[file]
+	}
+	key := anchorKey(file, id)
+	if link, ok := r.anchors[key]; ok {
+		return "", link
+	}
+	if !r.missingAnchors[key] {
+		if r.missingAnchors == nil {
+			r.missingAnchors = make(map[string]bool)
 		}
+		r.missingAnchors[key] = true
+		log.Printf("link to a missing anchor: %v", key)
+	}
+	r.tracer("Link", "missing anchor "+key)
+	return "", r.fileLinks[file]
+}
+
+// linkTarget returns the file and the heading ID a destination inside
+// the document points to.
+func (r *PdfRenderer) linkTarget(destination string) (file, id string, ok bool) {
+	if strings.HasPrefix(destination, "#") {
+		return r.file, destination[1:], true
+	}
+	if len(r.fileLinks) == 0 {
+		return "", "", false
+	}
+	u, err := url.Parse(destination)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", "", false
+	}
+	if strings.HasPrefix(u.Path, "/") {
+		// relative to the directory of the document
+		file = path.Clean(u.Path[1:])
+	} else {
+		file = path.Join(path.Dir(r.file), u.Path)
+	}
+	if _, ok := r.fileLinks[file]; !ok {
+		return "", "", false
+	}
+	return file, u.Fragment, true
+}
+
+// anchorKey is the key of the heading with an ID in a file of the
+// document in PdfRenderer.anchors.
+func anchorKey(file, id string) string {
+	return file + "#" + id
+}
+
+// fileKey is the name of a file of the document as links refer to it.
+func fileKey(name string) string {
+	if name == "" {
+		return ""
+	}
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// collectLinkTargets gives every file of the document and every heading
+// an fpdf internal link. The heading links are the targets of table of
+// contents entries and of #ID links; only the first heading with a
+// given ID in a file is such a target.
+func (r *PdfRenderer) collectLinkTargets(files []InputFile, docs []ast.Node) {
+	r.fileLinks = make(map[string]int)
+	r.headingLinks = make(map[*ast.Heading]int)
+	r.anchors = make(map[string]int)
+	for i, doc := range docs {
+		file := fileKey(files[i].Name)
+		if file != "" {
+			r.fileLinks[file] = r.Pdf.AddLink()
+		}
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if heading, ok := node.(*ast.Heading); ok && entering {
+				link := r.Pdf.AddLink()
+				r.headingLinks[heading] = link
+				key := anchorKey(file, heading.HeadingID)
+				if _, dup := r.anchors[key]; heading.HeadingID != "" && !dup {
+					r.anchors[key] = link
+				}
+			}
+			return ast.GoToNext
+		})
+	}
+}
+
+func (r *PdfRenderer) processLink(node ast.Link, entering bool) {
+	if node.NoteID > 0 {
+		r.processFootnoteMarker(node, entering)
+		return
+	}
+	if entering {
+		destination, anchor := r.resolveLink(string(node.Destination))
 		x := &containerState{
 			textStyle: r.Link, listkind: notlist,
 			leftMargin:  r.cs.peek().leftMargin,
-			destination: destination}
+			destination: destination, anchor: anchor}
+		// a link nested in struck-through text keeps the strike-out
+		if strings.Contains(r.cs.peek().textStyle.Style, "s") {
+			x.textStyle.Style += "s"
+		}
 		r.cs.push(x)
 		r.tracer("Link (entering)",
 			fmt.Sprintf("Destination[%v] Title[%v]",
@@ -330,121 +529,785 @@ func (r *PdfRenderer) processLink(node ast.Link, entering bool) {
 	}
 }
 
-func downloadFile(url, fileName string) error {
-	client := http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			fmt.Println("Redirected to:", req.URL)
-			return nil
-		},
+// processFootnoteMarker draws the raised number of a footnote reference,
+// linked to the note, and gives the note a place on the page.
+func (r *PdfRenderer) processFootnoteMarker(node ast.Link, entering bool) {
+	if !entering {
+		return
 	}
-	req, err := http.NewRequest("GET", url, nil)
+	fn := r.footnote(node.Footnote, node.NoteID)
+	r.tracer("Footnote marker", fmt.Sprintf("%v", fn.number))
+	style := r.cs.peek().textStyle
+	marker := style
+	marker.TextColor = r.Link.TextColor
+	r.setStyler(marker)
+	r.markFootnote(fn, r.Pdf.GetY())
+	r.Pdf.SubWrite(style.Size+style.Spacing, strconv.Itoa(fn.number),
+		style.Size*0.6, style.Size*0.35, fn.noteLink, "")
+	r.setStyler(style)
+	r.placeFootnote(fn)
+}
 
-	if err != nil {
-		return err
+// processFootnotesList draws all the notes at the current position when
+// they are collected as endnotes. Otherwise the notes have been drawn,
+// or will be, at the bottom of the pages that reference them.
+func (r *PdfRenderer) processFootnotesList(node *ast.List, entering bool) {
+	if !entering || !r.Endnotes {
+		return
+	}
+	r.tracer("Endnotes", fmt.Sprintf("%v notes", len(node.Children)))
+	r.cr()
+	pagew, _ := r.Pdf.GetPageSize()
+	width := pagew - r.mleft - r.mright
+	top, bottom := r.printableArea()
+	_, y := r.Pdf.GetXY()
+	y = r.footnoteRule(y)
+	for i, item := range node.Children {
+		fn := r.footnote(item, i+1)
+		if y+r.footnoteHeight(fn, width) > bottom && y > top {
+			r.addPage()
+			_, y = r.Pdf.GetXY()
+		}
+		y = r.drawFootnote(fn, y, width)
+	}
+	r.setStyler(r.cs.peek().textStyle)
+	r.Pdf.SetXY(r.mleft, y)
+}
+
+// footnote returns the note with the given number. Only the first
+// reference to a note carries the list item that holds its text; later
+// references get an empty item from the parser.
+func (r *PdfRenderer) footnote(item ast.Node, number int) *footnote {
+	if r.footnotes == nil {
+		r.footnotes = make(map[int]*footnote)
 	}
+	fn, ok := r.footnotes[number]
+	if !ok {
+		fn = &footnote{number: number, item: item, noteLink: r.Pdf.AddLink()}
+		r.footnotes[number] = fn
+	}
+	return fn
+}
 
-	req.Header.Add("User-Agent", "curl/7.84.0")
-	// Get the response bytes from the url
-	response, err := client.Do(req)
-	if err != nil {
-		return err
+// markFootnote makes the first marker of a note the target of the link
+// back from the note.
+func (r *PdfRenderer) markFootnote(fn *footnote, y float64) {
+	if fn.markerLink == 0 {
+		fn.markerLink = r.Pdf.AddLink()
+		r.Pdf.SetLink(fn.markerLink, y, -1)
 	}
-	defer response.Body.Close()
+}
 
-	if response.StatusCode != 200 {
-		return errors.New("Received non 200 response code: " + fmt.Sprintf("HTTP %d", response.StatusCode))
+// placeFootnote keeps space free for a note at the bottom of the current
+// page by raising the automatic page break. A note that does not fit
+// below the line of its marker goes to the bottom of the next page.
+func (r *PdfRenderer) placeFootnote(fn *footnote) {
+	if fn.placed || r.Endnotes {
+		return
 	}
-	// Create a empty file
-	file, err := os.Create(fileName)
-	if err != nil {
-		return err
+	fn.placed = true
+	if r.notesHeight == 0 && len(r.nextNotes) == 0 {
+		_, r.breakMargin = r.Pdf.GetAutoPageBreak()
 	}
-	defer file.Close()
+	pagew, pageh := r.Pdf.GetPageSize()
+	height := r.notesHeight + r.footnoteHeight(fn, pagew-r.mleft-r.mright)
+	if len(r.pageNotes) == 0 {
+		// room for the rule above the notes
+		height += r.Footnote.Size + r.Footnote.Spacing
+	}
+	style := r.cs.peek().textStyle
+	_, y := r.Pdf.GetXY()
+	if len(r.nextNotes) > 0 || y+style.Size+style.Spacing > pageh-r.breakMargin-height {
+		r.tracer("... Footnote", fmt.Sprintf("%v moves to the next page", fn.number))
+		r.nextNotes = append(r.nextNotes, fn)
+		return
+	}
+	r.pageNotes = append(r.pageNotes, fn)
+	r.reserveFootnotes(height)
+}
 
-	// Write the bytes to the file
-	_, err = io.Copy(file, response.Body)
-	if err != nil {
-		return err
+// reserveFootnotes keeps height free for notes above the bottom margin.
+func (r *PdfRenderer) reserveFootnotes(height float64) {
+	r.notesHeight = height
+	auto, _ := r.Pdf.GetAutoPageBreak()
+	r.Pdf.SetAutoPageBreak(auto, r.breakMargin+height)
+}
+
+// drawFootnotes draws the notes of the current page in the space kept
+// free for them, and keeps space on the next page for the notes that
+// did not fit. It is called just before a new page is started, in the
+// middle of laying out text, so it leaves the position, font and
+// colours as it found them.
+func (r *PdfRenderer) drawFootnotes() {
+	if len(r.pageNotes) == 0 && len(r.nextNotes) == 0 {
+		return
 	}
+	if len(r.pageNotes) > 0 {
+		r.tracer("Footnotes",
+			fmt.Sprintf("drawing %v notes on page %v", len(r.pageNotes), r.Pdf.PageNo()))
+		x, y := r.Pdf.GetXY()
+		style := r.current
+		size, _ := r.Pdf.GetFontSize()
+		tr, tg, tb := r.Pdf.GetTextColor()
+		fr, fg, fb := r.Pdf.GetFillColor()
+		auto, margin := r.Pdf.GetAutoPageBreak()
+		r.Pdf.SetAutoPageBreak(false, margin)
 
-	return nil
+		pagew, pageh := r.Pdf.GetPageSize()
+		width := pagew - r.mleft - r.mright
+		top := r.footnoteRule(pageh - r.breakMargin - r.notesHeight)
+		for _, fn := range r.pageNotes {
+			top = r.drawFootnote(fn, top, width)
+		}
+
+		r.Pdf.SetAutoPageBreak(auto, margin)
+		r.setStyler(style)
+		r.Pdf.SetFontSize(size)
+		r.Pdf.SetTextColor(tr, tg, tb)
+		r.Pdf.SetFillColor(fr, fg, fb)
+		r.Pdf.SetXY(x, y)
+	}
+	r.pageNotes, r.nextNotes = r.nextNotes, nil
+	height := 0.0
+	if len(r.pageNotes) > 0 {
+		pagew, _ := r.Pdf.GetPageSize()
+		height = r.Footnote.Size + r.Footnote.Spacing
+		for _, fn := range r.pageNotes {
+			height += r.footnoteHeight(fn, pagew-r.mleft-r.mright)
+		}
+	}
+	r.reserveFootnotes(height)
+}
+
+// finishFootnotes draws the notes still waiting for the bottom of a page
+// once the whole document has been laid out.
+func (r *PdfRenderer) finishFootnotes() {
+	// notes that are only referenced from other notes have no place yet
+	notes := make([]*footnote, 0, len(r.footnotes))
+	for _, fn := range r.footnotes {
+		notes = append(notes, fn)
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].number < notes[j].number })
+	for _, fn := range notes {
+		r.placeFootnote(fn)
+	}
+	r.drawFootnotes()
+	for len(r.pageNotes) > 0 {
+		r.Pdf.AddPage()
+		r.drawFootnotes()
+	}
+	r.footnotes = nil
+}
+
+// footnoteRule draws the short rule that separates notes from the text
+// above them and returns the position of the first note.
+func (r *PdfRenderer) footnoteRule(y float64) float64 {
+	pagew, _ := r.Pdf.GetPageSize()
+	lh := r.Footnote.Size + r.Footnote.Spacing
+	dr, dg, db := r.Pdf.GetDrawColor()
+	c := r.Footnote.TextColor
+	r.Pdf.SetDrawColor(c.Red, c.Green, c.Blue)
+	r.Pdf.Line(r.mleft, y+lh/2, r.mleft+(pagew-r.mleft-r.mright)/3, y+lh/2)
+	r.Pdf.SetDrawColor(dr, dg, db)
+	return y + lh
+}
+
+// drawFootnote draws a note at y and returns the position below it.
+func (r *PdfRenderer) drawFootnote(fn *footnote, y, width float64) float64 {
+	lines := r.footnoteLines(fn, width)
+	lh := r.Footnote.Size + r.Footnote.Spacing
+	r.tracer("... Footnote", fmt.Sprintf("%v, lines=%v", fn.number, len(lines)))
+	r.Pdf.SetLink(fn.noteLink, y, -1)
+	r.drawRuns(lines, r.mleft, y, width, 0, lh, "L")
+	return y + float64(len(lines))*lh
+}
+
+func (r *PdfRenderer) footnoteHeight(fn *footnote, width float64) float64 {
+	return float64(len(r.footnoteLines(fn, width))) * (r.Footnote.Size + r.Footnote.Spacing)
 }
 
-func (r *PdfRenderer) processImage(node ast.Image, entering bool) {
+// footnoteLines wraps the text of a note, after its number, to width.
+// Each paragraph of the note starts on a new line.
+func (r *PdfRenderer) footnoteLines(fn *footnote, width float64) [][]cellRun {
+	label := r.Footnote
+	label.TextColor = r.Link.TextColor
+	runs := []cellRun{
+		{text: fmt.Sprintf("%v.", fn.number), style: label, internal: fn.markerLink},
+		{text: " ", style: r.Footnote}}
+	blocks := []ast.Node{fn.item}
+	if _, ok := ast.GetFirstChild(fn.item).(*ast.Paragraph); ok {
+		blocks = fn.item.GetChildren()
+	}
+	var lines [][]cellRun
+	for _, block := range blocks {
+		runs = append(runs, r.inlineRuns(block, r.Footnote)...)
+		lines = append(lines, r.wrapRuns(runs, width)...)
+		runs = nil
+	}
+	return lines
+}
+
+// addPage starts a new page, drawing the notes of the current one first.
+func (r *PdfRenderer) addPage() {
+	r.drawFootnotes()
+	r.Pdf.AddPage()
+}
+
+func (r *PdfRenderer) processImage(node *ast.Image, entering bool) ast.WalkStatus {
 	// while this has entering and leaving states, it doesn't appear
 	// to be useful except for other markup languages to close the tag
 	if entering {
-		r.cr() // newline before getting started
+		inline := isInlineImage(node)
+		if !inline {
+			r.cr() // newline before getting started
+		}
 		destination := string(node.Destination)
-		tempDir := os.TempDir() + "/" + filepath.Base(os.Args[0])
-		_, err := os.Stat(destination)
-		if errors.Is(err, os.ErrNotExist) {
-			// download the image so we can use it
-			var source string = destination
-			if !strings.HasPrefix(destination, "http") {
-				if r.InputBaseURL != "" {
-					source = r.InputBaseURL + "/" + destination
-				}
-			}
-			os.MkdirAll(tempDir, 755)
-			err := downloadFile(source, tempDir+"/"+filepath.Base(destination))
-			if err != nil {
-				fmt.Println(err.Error())
-			} else {
-				destination = tempDir + "/" + filepath.Base(destination)
-				fmt.Println("Downloaded image to: " + destination)
-			}
-		}
-		mtype, err := mimetype.DetectFile(destination)
-		if mtype.Is("image/svg+xml") {
-			re := regexp.MustCompile(`<svg\s*.*\s*width="([0-9\.]+)"\sheight="([0-9\.]+)".*>`)
-			contents, _ := os.ReadFile(destination)
-			matches := re.FindStringSubmatch(string(contents))
-			tf, err := os.CreateTemp(tempDir, "*.svg")
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			if _, err := tf.Write(contents); err != nil {
-				tf.Close()
-				log.Println(err)
-				return
-			}
-			if err := tf.Close(); err != nil {
-				log.Println(err)
-				return
-			}
-			os.Rename(destination, tf.Name())
-			destination = tf.Name()
-			width, _ := strconv.ParseFloat(matches[1], 64)
-			height, _ := strconv.ParseFloat(matches[2], 64)
-			chrome := svg2png.NewChrome().SetHeight(int(height)).SetWith(int(width))
-			outputFileName := destination + ".png"
-			if err := chrome.Screenshoot(destination, outputFileName); err != nil {
-				log.Println(err)
-				return
-			}
-			destination = outputFileName
+		shown := destination
+		if isDataURI(destination) && len(shown) > 40 {
+			shown = fmt.Sprintf("%v... (%d bytes)", shown[:40], len(shown))
 		}
 		r.tracer("Image (entering)",
 			fmt.Sprintf("Destination[%v] Title[%v]",
-				destination,
+				shown,
 				string(node.Title)))
-		// following changes suggested by @sirnewton01, issue #6
-		// does file exist?
-		var imgPath = destination
-		_, err = os.Stat(imgPath)
-		if err == nil {
-			r.Pdf.ImageOptions(destination,
-				-1, 0, 0, 0, true,
-				fpdf.ImageOptions{ImageType: "", ReadDpi: true}, 0, "")
+
+		link, linkStr := r.imageLink(node)
+		if inline {
+			if !r.drawInlineImage(destination, link, linkStr) {
+				// the alt text is written in its place
+				return ast.GoToNext
+			}
+			return ast.SkipChildren
+		}
+		attrs := imageAttributes(node)
+		alt := r.inlineRuns(node, r.Caption)
+		if headingText(node) == "" {
+			alt = nil
+		}
+		var caption [][]cellRun
+		below := 0.0
+		if r.ImageCaptions && !inCaptionFigure(node) {
+			caption = r.imageCaption(node, alt)
+			below = float64(len(caption)) * (r.Caption.Size + r.Caption.Spacing)
+		}
+		status := ast.GoToNext
+		if !r.drawImage(destination, attrs, below, link, linkStr) {
+			if len(alt) == 0 && !isDataURI(destination) {
+				alt = []cellRun{{text: path.Base(destination), style: r.Caption}}
+			}
+			r.drawImagePlaceholder(alt, attrs, below)
+			status = ast.SkipChildren
+		}
+		if caption != nil {
+			r.drawCaption(caption, attrs["align"])
+			status = ast.SkipChildren
+		}
+		return status
+	}
+	r.tracer("Image (leaving)", "")
+	return ast.GoToNext
+}
+
+// drawImage draws an image at the current position, keeping room for
+// below, e.g. a caption, on the same page, linked to link or linkStr if
+// either is set. It reports whether the image could be loaded.
+func (r *PdfRenderer) drawImage(name string, attrs map[string]string, below float64, link int, linkStr string) bool {
+	if !r.Pdf.Ok() {
+		return false
+	}
+	img, err := r.loadImage(name)
+	if err == nil && (img.width <= 0 || img.height <= 0) {
+		err = errors.New("empty image")
+	}
+	if err != nil {
+		r.tracer("Image (error)", err.Error())
+		return false
+	}
+	// the size of the image at its resolution, in the unit of the PDF
+	k := r.Pdf.GetConversionRatio()
+	w := float64(img.width) * 72 / img.dpi / k
+	h := float64(img.height) * 72 / img.dpi / k
+	w, h = r.imageSize(w, h, attrs)
+	x, y, w, h := r.placeImage(w, h, attrs["align"], below)
+	img = r.compressImage(img, w*k, h*k)
+	if err := r.registerImage(img); err != nil {
+		r.tracer("Image (error)", err.Error())
+		return false
+	}
+	r.tracer("Image", fmt.Sprintf("x=%v, y=%v, width=%v, height=%v", x, y, w, h))
+	r.Pdf.ImageOptions(img.key, x, y, w, h, false, fpdf.ImageOptions{}, link, linkStr)
+	lm, _, _, _ := r.Pdf.GetMargins()
+	r.Pdf.SetXY(lm, y+h)
+	return true
+}
+
+// drawInlineImage draws an image in the current line of text, standing
+// on the baseline and as tall as the line is above it, and moves the
+// position past it. The image goes to the next line if it doesn't fit
+// on this one. It reports whether the image could be loaded.
+func (r *PdfRenderer) drawInlineImage(name string, link int, linkStr string) bool {
+	if !r.Pdf.Ok() {
+		return false
+	}
+	img, err := r.loadImage(name)
+	if err == nil && (img.width <= 0 || img.height <= 0) {
+		err = errors.New("empty image")
+	}
+	if err != nil {
+		r.tracer("Image (error)", err.Error())
+		return false
+	}
+	s := r.cs.peek().textStyle
+	lh := s.Size + s.Spacing
+	// fpdf writes text with its baseline 0.3em below the middle of the line
+	baseline := lh/2 + 0.3*s.Size
+	h := baseline
+	w := h * float64(img.width) / float64(img.height)
+	if avail := r.contentWidth(); w > avail {
+		w, h = avail, h*avail/w
+	}
+	pagew, _ := r.Pdf.GetPageSize()
+	lm, _, rm, _ := r.Pdf.GetMargins()
+	x, y := r.Pdf.GetXY()
+	if x+w > pagew-rm && x > lm {
+		x, y = lm, y+lh
+	}
+	if _, bottom := r.printableArea(); y+lh > bottom {
+		r.addPage()
+		x, y = r.Pdf.GetXY()
+	}
+	k := r.Pdf.GetConversionRatio()
+	img = r.compressImage(img, w*k, h*k)
+	if err := r.registerImage(img); err != nil {
+		r.tracer("Image (error)", err.Error())
+		return false
+	}
+	r.tracer("Image (inline)", fmt.Sprintf("x=%v, y=%v, width=%v, height=%v", x, y+baseline-h, w, h))
+	r.Pdf.ImageOptions(img.key, x, y+baseline-h, w, h, false, fpdf.ImageOptions{}, link, linkStr)
+	r.Pdf.SetXY(x+w, y)
+	return true
+}
+
+// isInlineImage tells if an image is part of a line of text: the line
+// of its paragraph, or the link around it, has other content than the
+// image and white space. An image on a line of its own is a block.
+func isInlineImage(node *ast.Image) bool {
+	var inner ast.Node = node
+	if link, ok := node.Parent.(*ast.Link); ok {
+		if !aloneOnLine(link, node) {
+			return true
+		}
+		inner = link
+	}
+	para, ok := inner.GetParent().(*ast.Paragraph)
+	return ok && !aloneOnLine(para, inner)
+}
+
+// aloneOnLine tells if node is the only content, but for white space, of
+// its line among the children of container.
+func aloneOnLine(container ast.Node, node ast.Node) bool {
+	children := container.GetChildren()
+	i := 0
+	for i < len(children) && children[i] != node {
+		i++
+	}
+	for j := i - 1; j >= 0; j-- {
+		line, end, ok := lineText(children[j])
+		if !ok {
+			return false
+		}
+		if k := bytes.LastIndexByte(line, '\n'); k >= 0 {
+			line, end = line[k+1:], true
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			return false
+		}
+		if end {
+			break
+		}
+	}
+	for j := i + 1; j < len(children); j++ {
+		line, end, ok := lineText(children[j])
+		if !ok {
+			return false
+		}
+		if k := bytes.IndexByte(line, '\n'); k >= 0 {
+			line, end = line[:k], true
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			return false
+		}
+		if end {
+			break
+		}
+	}
+	return true
+}
+
+// lineText returns the text of a node that is text or a line break, and
+// whether it is a line break.
+func lineText(node ast.Node) (text []byte, lineBreak bool, ok bool) {
+	switch node := node.(type) {
+	case *ast.Text:
+		return node.Literal, false, true
+	case *ast.Softbreak, *ast.Hardbreak:
+		return nil, true, true
+	}
+	return nil, false, false
+}
+
+// imageLink returns the link of an image inside a link, e.g.
+// [![badge](badge.svg)](https://example.com), as an fpdf internal link
+// or a URL.
+func (r *PdfRenderer) imageLink(node *ast.Image) (int, string) {
+	if _, ok := node.Parent.(*ast.Link); !ok {
+		return 0, ""
+	}
+	link := r.cs.peek()
+	return link.anchor, link.destination
+}
+
+// registerImage registers an image with the PDF under its key, the hash
+// of its content, so that an image is embedded once however often and
+// under whatever names it is used. An image that can't be registered
+// doesn't spoil the document.
+func (r *PdfRenderer) registerImage(img *cachedImage) error {
+	if info := r.Pdf.GetImageInfo(img.key); info != nil {
+		return nil
+	}
+	info := r.Pdf.RegisterImageOptionsReader(img.key, img.options, bytes.NewReader(img.data))
+	if err := r.Pdf.Error(); err != nil {
+		r.Pdf.ClearError()
+		return err
+	}
+	info.SetDpi(img.dpi)
+	return nil
+}
+
+// loadImage returns an image from the ImageCache, loading it if it
+// isn't there. Remote images are looked up by URL and FetchPolicy, so
+// they are fetched once under each policy; other images, and all images
+// of a ResourceLoader, are loaded and then looked up by content.
+func (r *PdfRenderer) loadImage(name string) (*cachedImage, error) {
+	if r.ImageCache == nil {
+		r.ImageCache = NewImageCache()
+	}
+	load := func() (*cachedImage, error) {
+		data, err := r.loadResource(name)
+		if err != nil {
+			return nil, err
+		}
+		key := imageKey(data)
+		img, cached, err := r.ImageCache.load(key, func() (*cachedImage, error) {
+			return r.prepareImage(key, data)
+		})
+		if cached && err == nil {
+			r.tracer("Image (cached)", key)
+		}
+		return img, err
+	}
+	if !isRemote(name) || r.ResourceLoader != nil {
+		return load()
+	}
+	img, cached, err := r.ImageCache.load(fmt.Sprintf("%v %+v", name, r.FetchPolicy), load)
+	if cached && err == nil {
+		r.tracer("Image (cached)", img.key)
+	}
+	return img, err
+}
+
+// prepareImage readies an image for fpdf. The type of the image is taken
+// from its content. SVG images are rasterised, at a resolution that keeps
+// their size, and images fpdf can't read, e.g. WebP, BMP and TIFF
+// images, are converted to PNG.
+func (r *PdfRenderer) prepareImage(key string, data []byte) (*cachedImage, error) {
+	img := &cachedImage{key: key, dpi: 72}
+	var err error
+	mtype := mimetype.Detect(data)
+	switch {
+	case mtype.Is("image/svg+xml"):
+		if data, img.dpi, err = rasterizeSVG(data); err != nil {
+			return nil, err
+		}
+		img.options.ImageType = "PNG"
+	case mtype.Is("image/jpeg"):
+		img.options.ImageType = "JPG"
+	case mtype.Is("image/png") && pngSupported(data):
+		img.options.ImageType = "PNG"
+		img.dpi = pngDPI(data)
+	case mtype.Is("image/gif"):
+		img.options.ImageType = "GIF"
+	default:
+		if data, err = convertImage(data); err != nil {
+			return nil, fmt.Errorf("unsupported image type %v: %w", mtype, err)
+		}
+		r.tracer("Image (converted to PNG)", mtype.String())
+		img.options.ImageType = "PNG"
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", mtype, err)
+	}
+	img.data, img.width, img.height = data, config.Width, config.Height
+	return img, nil
+}
+
+// compressImage returns an image downsampled to ImageDPI if it has more
+// than half as many pixels again as it needs at the size it is drawn
+// at, w by h points, or a JPEG image recompressed at JPEGQuality if that
+// makes it smaller. Otherwise, or if that fails, it returns img.
+func (r *PdfRenderer) compressImage(img *cachedImage, w, h float64) *cachedImage {
+	isJPEG := img.options.ImageType == "JPG"
+	pw, ph := img.width, img.height
+	if r.ImageDPI > 0 {
+		tw := int(math.Ceil(w / 72 * r.ImageDPI))
+		th := int(math.Ceil(h / 72 * r.ImageDPI))
+		if float64(pw) > 1.5*float64(tw) || float64(ph) > 1.5*float64(th) {
+			if tw < pw {
+				pw = tw
+			}
+			if th < ph {
+				ph = th
+			}
+		}
+	}
+	downsample := pw != img.width || ph != img.height
+	if !downsample && (!isJPEG || r.JPEGQuality <= 0) {
+		return img
+	}
+	quality := r.JPEGQuality
+	if quality <= 0 {
+		quality = defaultJPEGQuality
+	}
+	key := fmt.Sprintf("%v@%dx%d", img.key, pw, ph)
+	if isJPEG {
+		key += fmt.Sprintf(",q%d", quality)
+	}
+	compressed, _, err := r.ImageCache.load(key, func() (*cachedImage, error) {
+		data, err := resampleImage(img.data, pw, ph, isJPEG, quality)
+		if err != nil {
+			r.tracer("Image (compression error)", err.Error())
+			return nil, err
+		}
+		if !downsample && len(data) >= len(img.data) {
+			return img, nil
+		}
+		compressed := &cachedImage{key: key, data: data,
+			width: pw, height: ph, dpi: img.dpi * float64(pw) / float64(img.width)}
+		compressed.options.ImageType = "PNG"
+		if isJPEG {
+			compressed.options.ImageType = "JPG"
+		}
+		r.tracer("Image (compressed)", fmt.Sprintf("%dx%d to %dx%d pixels, %d to %d bytes",
+			img.width, img.height, pw, ph, len(img.data), len(data)))
+		return compressed, nil
+	})
+	if err != nil {
+		return img
+	}
+	return compressed
+}
+
+// imageSize returns the size of an image of width w and height h, as
+// requested by its attributes. The image is scaled down to fit the
+// content width and the page height. Images without a requested size
+// are also kept to ImageMaxWidth.
+func (r *PdfRenderer) imageSize(w, h float64, attrs map[string]string) (float64, float64) {
+	avail := r.contentWidth()
+	top, bottom := r.printableArea()
+	width, hasWidth := r.imageLength(attrs["width"], avail)
+	height, hasHeight := r.imageLength(attrs["height"], bottom-top)
+	switch {
+	case hasWidth && hasHeight:
+		w, h = width, height
+	case hasWidth:
+		w, h = width, h*width/w
+	case hasHeight:
+		w, h = w*height/h, height
+	default:
+		if r.ImageMaxWidth > 0 && w > r.ImageMaxWidth {
+			w, h = r.ImageMaxWidth, h*r.ImageMaxWidth/w
+		}
+	}
+	if w > avail {
+		w, h = avail, h*avail/w
+	}
+	if h > bottom-top {
+		w, h = w*(bottom-top)/h, bottom-top
+	}
+	return w, h
+}
+
+// placeImage returns the position and size of an image at the current
+// position, aligned left, center or right. An image too tall for the
+// rest of the page, less below, is scaled down to fit if that keeps at
+// least half of its size; it goes on a new page otherwise.
+func (r *PdfRenderer) placeImage(w, h float64, align string, below float64) (x, y, width, height float64) {
+	_, bottom := r.printableArea()
+	_, y = r.Pdf.GetXY()
+	if room := bottom - below - y; h > room {
+		if room >= h/2 {
+			w, h = w*room/h, room
 		} else {
-			r.tracer("Image (file error)", err.Error())
+			r.addPage()
+			_, y = r.Pdf.GetXY()
 		}
-	} else {
-		r.tracer("Image (leaving)", "")
 	}
+	avail := r.contentWidth()
+	x, _, _, _ = r.Pdf.GetMargins()
+	switch align {
+	case "center":
+		x += (avail - w) / 2
+	case "right":
+		x += avail - w
+	}
+	return x, y, w, h
+}
+
+// drawImagePlaceholder draws a box with the alt text of an image that
+// could not be loaded, in place of the image.
+func (r *PdfRenderer) drawImagePlaceholder(alt []cellRun, attrs map[string]string, below float64) {
+	avail := r.contentWidth()
+	top, bottom := r.printableArea()
+	w, ok := r.imageLength(attrs["width"], avail)
+	if !ok || w > avail {
+		w = avail / 2
+	}
+	lh := r.Caption.Size + r.Caption.Spacing
+	margin := lh / 2
+	lines := r.wrapRuns(alt, w-2*margin)
+	textHeight := float64(len(lines)) * lh
+	h := textHeight + 2*margin
+	if height, ok := r.imageLength(attrs["height"], bottom-top); ok && height > h {
+		h = math.Min(height, bottom-top)
+	}
+	x, y, w, h := r.placeImage(w, h, attrs["align"], below)
+	r.tracer("Image (placeholder)", fmt.Sprintf("x=%v, y=%v, width=%v, height=%v", x, y, w, h))
+	r.Pdf.Rect(x, y, w, h, "D")
+	r.drawRuns(lines, x, y+(h-textHeight)/2, w, margin, lh, "C")
+	lm, _, _, _ := r.Pdf.GetMargins()
+	r.Pdf.SetXY(lm, y+h)
+}
+
+// imageCaption numbers an image as a figure and returns its caption,
+// wrapped to the content width. The caption is the title of the image,
+// or else its alt text.
+func (r *PdfRenderer) imageCaption(node *ast.Image, alt []cellRun) [][]cellRun {
+	r.figureNumber++
+	label := r.Caption
+	label.Style += "b"
+	runs := []cellRun{{text: fmt.Sprintf("Figure %v", r.figureNumber), style: label}}
+	text := alt
+	if title := strings.TrimSpace(string(node.Title)); title != "" {
+		if _, ok := titleAttributes(title); !ok {
+			text = []cellRun{{text: title, style: r.Caption}}
+		}
+	}
+	if len(text) > 0 {
+		runs[0].text += ": "
+		runs = append(runs, text...)
+	}
+	r.tracer("Image caption", fmt.Sprintf("Figure %v", r.figureNumber))
+	return r.wrapRuns(mergeRuns(runs), r.contentWidth())
+}
+
+// drawCaption draws the lines of a caption at the current position,
+// aligned like its image, and moves the position below them.
+func (r *PdfRenderer) drawCaption(lines [][]cellRun, align string) {
+	lh := r.Caption.Size + r.Caption.Spacing
+	lm, _, _, _ := r.Pdf.GetMargins()
+	_, y := r.Pdf.GetXY()
+	switch align {
+	case "center":
+		align = "C"
+	case "right":
+		align = "R"
+	default:
+		align = "L"
+	}
+	r.drawRuns(lines, lm, y, r.contentWidth(), 0, lh, align)
+	r.Pdf.SetXY(lm, y+float64(len(lines))*lh)
+}
+
+// inCaptionFigure tells if an image has a caption of its own, e.g.
+// "Figure: ..." after it.
+func inCaptionFigure(node ast.Node) bool {
+	for p := node.GetParent(); p != nil; p = p.GetParent() {
+		if _, ok := p.(*ast.CaptionFigure); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// contentWidth returns the width of the page between the margins.
+func (r *PdfRenderer) contentWidth() float64 {
+	pagew, _ := r.Pdf.GetPageSize()
+	lm, _, rm, _ := r.Pdf.GetMargins()
+	return pagew - lm - rm
+}
+
+// imageAttributes returns the width, height and align attributes of an
+// image. They are taken from an attribute block before the paragraph of
+// the image, e.g. {width="50%" align="center"}, or from a title that is
+// made up of such attributes only, e.g. "width=50% align=center".
+func imageAttributes(node *ast.Image) map[string]string {
+	attrs := map[string]string{}
+	add := func(a *ast.Attribute) {
+		if a == nil {
+			return
+		}
+		for k, v := range a.Attrs {
+			if isImageAttribute(k) {
+				attrs[k] = string(v)
+			}
+		}
+	}
+	if p, ok := node.Parent.(*ast.Paragraph); ok {
+		add(p.Attribute)
+	}
+	add(node.Attribute)
+	if title, ok := titleAttributes(string(node.Title)); ok {
+		for k, v := range title {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// titleAttributes parses an image title made up of image attributes
+// only; it reports false for a plain title.
+func titleAttributes(title string) (map[string]string, bool) {
+	fields := strings.Fields(title)
+	if len(fields) == 0 {
+		return nil, false
+	}
+	attrs := map[string]string{}
+	for _, f := range fields {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || !isImageAttribute(k) {
+			return nil, false
+		}
+		attrs[k] = strings.Trim(v, `"'`)
+	}
+	return attrs, true
+}
+
+func isImageAttribute(name string) bool {
+	return name == "width" || name == "height" || name == "align"
+}
+
+// imageLength converts an image width or height such as "50%", "300",
+// "300px", "4cm", "40mm", "2in" or "144pt" to the unit of the PDF.
+// Percentages are of full, and plain numbers are pixels.
+func (r *PdfRenderer) imageLength(value string, full float64) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if percent := strings.TrimSuffix(value, "%"); percent != value {
+		n, err := strconv.ParseFloat(percent, 64)
+		return full * n / 100, err == nil && n > 0
+	}
+	points, ok := parseLength(value)
+	return points / r.Pdf.GetConversionRatio(), ok
 }
 
 func (r *PdfRenderer) processCode(node ast.Node) {
@@ -522,7 +1385,7 @@ func (r *PdfRenderer) processBlockQuote(node ast.Node, entering bool) {
 	}
 }
 
-func (r *PdfRenderer) processHeading(node ast.Heading, entering bool) {
+func (r *PdfRenderer) processHeading(node *ast.Heading, entering bool) {
 	if entering {
 		r.cr()
 		switch node.Level {
@@ -563,6 +1426,7 @@ func (r *PdfRenderer) processHeading(node ast.Heading, entering bool) {
 				leftMargin: r.cs.peek().leftMargin}
 			r.cs.push(x)
 		}
+		r.markHeading(node)
 	} else {
 		r.tracer("Heading (leaving)", "")
 		r.cr()
@@ -570,10 +1434,222 @@ func (r *PdfRenderer) processHeading(node ast.Heading, entering bool) {
 	}
 }
 
+// markHeading records the place of a heading for links to it, its table
+// of contents entry and its bookmark. A heading that would not fit on
+// the page starts the next one here, so that both point at the page
+// with the heading.
+func (r *PdfRenderer) markHeading(node *ast.Heading) {
+	style := r.cs.peek().textStyle
+	top, bottom := r.printableArea()
+	if _, y := r.Pdf.GetXY(); y+style.Size+style.Spacing > bottom && y > top {
+		r.addPage()
+	}
+	if link, ok := r.headingLinks[node]; ok {
+		r.Pdf.SetLink(link, r.Pdf.GetY(), -1)
+	}
+	if r.contents != nil {
+		if entry, ok := r.contents.headings[node]; ok {
+			entry.page = r.Pdf.PageNo()
+		}
+	}
+	if node.Level <= r.BookmarkDepth {
+		// the outline has no room for skipped levels, e.g. a level 3
+		// heading straight after a level 1 heading
+		level := node.Level - 1 + r.bookmarkBase
+		if level > r.bookmarkLevel+1 {
+			level = r.bookmarkLevel + 1
+		}
+		r.Pdf.Bookmark(headingText(node), level, -1)
+		r.bookmarkLevel = level
+	}
+}
+
+// collectContents gathers the headings of the documents for a table of
+// contents. Unless there is a [TOC] paragraph, pages are kept free for
+// the contents at the start.
+func (r *PdfRenderer) collectContents(docs []ast.Node) {
+	c := &contents{headings: make(map[*ast.Heading]*contentsEntry)}
+	marker := false
+	for _, doc := range docs {
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if !entering {
+				return ast.GoToNext
+			}
+			switch node := node.(type) {
+			case *ast.Heading:
+				entry := &contentsEntry{level: node.Level, text: headingText(node), link: r.headingLinks[node]}
+				c.entries = append(c.entries, entry)
+				c.headings[node] = entry
+				return ast.SkipChildren
+			case *ast.Paragraph:
+				marker = marker || isContentsMarker(node)
+			}
+			return ast.GoToNext
+		})
+	}
+	r.tracer("Contents", fmt.Sprintf("%v headings", len(c.entries)))
+	r.contents = c
+	if !marker {
+		r.placeContents()
+	}
+}
+
+func (r *PdfRenderer) processContentsMarker(node *ast.Paragraph, entering bool) {
+	if entering {
+		r.tracer("Contents", "[TOC]")
+		r.placeContents()
+	}
+}
+
+// placeContents keeps pages free for the table of contents, starting on
+// a new page unless the current one is still empty. The document goes
+// on after the contents on a new page.
+func (r *PdfRenderer) placeContents() {
+	c := r.contents
+	if c.firstPage != 0 {
+		r.tracer("Contents", "already placed")
+		return
+	}
+	top, _ := r.printableArea()
+	if _, y := r.Pdf.GetXY(); y > top {
+		r.addPage()
+	}
+	c.firstPage = r.Pdf.PageNo()
+	c.top, c.bottom = r.printableArea()
+	c.pages = r.layoutContents(c, false)
+	r.tracer("Contents", fmt.Sprintf("%v pages from page %v", c.pages, c.firstPage))
+	for i := 1; i < c.pages; i++ {
+		r.addPage()
+	}
+	r.addPage()
+	r.setStyler(r.cs.peek().textStyle)
+}
+
+// drawContents fills in the pages kept free for the table of contents
+// once the document has been laid out, then returns to the last page.
+func (r *PdfRenderer) drawContents() {
+	c := r.contents
+	r.contents = nil
+	if c == nil || c.firstPage == 0 {
+		return
+	}
+	last := r.Pdf.PageNo()
+	x, y := r.Pdf.GetXY()
+	style := r.current
+	auto, margin := r.Pdf.GetAutoPageBreak()
+	r.Pdf.SetAutoPageBreak(false, margin)
+
+	r.revisitPage(c.firstPage)
+	r.layoutContents(c, true)
+
+	r.setStyler(style)
+	r.revisitPage(last)
+	r.Pdf.SetAutoPageBreak(auto, margin)
+	r.Pdf.SetXY(x, y)
+}
+
+// revisitPage makes an earlier page the current one. The font in use at
+// the end of that page is not known to fpdf, so it is set again.
+func (r *PdfRenderer) revisitPage(page int) {
+	r.Pdf.SetPage(page)
+	size, _ := r.Pdf.GetFontSize()
+	r.Pdf.SetFontSize(size)
+}
+
+// layoutContents lays out the table of contents from the top of its
+// first page and returns the number of pages it takes. The entries are
+// only drawn if draw is set.
+func (r *PdfRenderer) layoutContents(c *contents, draw bool) int {
+	pagew, _ := r.Pdf.GetPageSize()
+	top, bottom := c.top, c.bottom
+	width := pagew - r.mleft - r.mright
+	lh := r.TOC.Size + r.TOC.Spacing
+	page, y := c.firstPage, top
+	if r.TOCTitle != "" {
+		if draw {
+			title := [][]cellRun{{{text: r.TOCTitle, style: r.H1}}}
+			r.drawRuns(title, r.mleft, y, width, 0, r.H1.Size+r.H1.Spacing, "L")
+		}
+		y += r.H1.Size + r.H1.Spacing + lh
+	}
+	r.setStyler(r.TOC)
+	numw := r.Pdf.GetStringWidth("0000")
+	for _, entry := range c.entries {
+		style := r.TOC
+		if entry.level == 1 {
+			style.Style += "b"
+		}
+		indent := float64(entry.level-1) * r.IndentValue
+		run := cellRun{text: entry.text, style: style, internal: entry.link}
+		lines := r.wrapRuns([]cellRun{run}, width-indent-numw-2*r.em)
+		if h := float64(len(lines)) * lh; y+h > bottom && y > top {
+			page, y = page+1, top
+			if draw {
+				r.revisitPage(page)
+			}
+		}
+		if draw {
+			r.drawContentsEntry(entry, lines, r.mleft+indent, y, width-indent, numw)
+		}
+		y += float64(len(lines)) * lh
+	}
+	return page - c.firstPage + 1
+}
+
+// drawContentsEntry draws the wrapped heading text of an entry, then dot
+// leaders and the page number at the right margin.
+func (r *PdfRenderer) drawContentsEntry(entry *contentsEntry, lines [][]cellRun, x, y, width, numw float64) {
+	lh := r.TOC.Size + r.TOC.Spacing
+	r.drawRuns(lines, x, y, width, 0, lh, "L")
+	if entry.page == 0 {
+		// the heading was not drawn, e.g. because it is in a footnote
+		return
+	}
+	last := lines[len(lines)-1]
+	y += float64(len(lines)-1) * lh
+	r.setStyler(r.TOC)
+	start := x + r.runsWidth(last) + r.spaceWidth(r.TOC)
+	end := x + width - numw
+	if dots := int((end - start) / r.Pdf.GetStringWidth(".")); dots > 0 {
+		leader := strings.Repeat(".", dots)
+		lw := r.Pdf.GetStringWidth(leader)
+		r.Pdf.SetXY(end-lw, y)
+		r.Pdf.CellFormat(lw, lh, leader, "", 0, "C", false, entry.link, "")
+	}
+	r.Pdf.SetXY(end, y)
+	r.Pdf.CellFormat(numw, lh, strconv.Itoa(entry.page), "", 0, "R", false, entry.link, "")
+}
+
+// isContentsMarker tells if a paragraph holds only [TOC], which marks
+// the place of the table of contents.
+func isContentsMarker(node *ast.Paragraph) bool {
+	children := node.GetChildren()
+	if len(children) != 1 {
+		return false
+	}
+	text, ok := children[0].(*ast.Text)
+	return ok && strings.TrimSpace(string(text.Literal)) == "[TOC]"
+}
+
+// headingText returns the text of a heading without its formatting.
+func headingText(heading ast.Node) string {
+	var b strings.Builder
+	ast.WalkFunc(heading, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch node := node.(type) {
+		case *ast.Text:
+			b.Write(node.Literal)
+		case *ast.Code:
+			b.Write(node.Literal)
+		}
+		return ast.GoToNext
+	})
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
 func (r *PdfRenderer) processHorizontalRule(node ast.Node) {
 	r.tracer("HorizontalRule", "")
 	if r.HorizontalRuleNewPage {
-		r.Pdf.AddPage()
+		r.addPage()
 	} else {
 		// do a newline
 		r.cr()
@@ -613,14 +1689,23 @@ func (r *PdfRenderer) processTable(node ast.Node, entering bool) {
 			textStyle: r.THeader, listkind: notlist,
 			leftMargin: r.cs.peek().leftMargin}
 		r.cr()
+		t := &tableState{}
+		x.table = t
 		r.cs.push(x)
-		fill = false
-	} else {
-		wSum := 0.0
-		for _, w := range cellwidths {
-			wSum += w
+		for _, section := range node.GetChildren() {
+			if _, ok := section.(*ast.TableHeader); ok {
+				t.header = section
+			}
 		}
-		r.Pdf.CellFormat(wSum, 0, "", "T", 0, "", false, 0, "")
+		// layout pass: the column widths come from the content of
+		// the whole table, not just the header
+		t.cellwidths = r.tableColumnWidths(node)
+		r.tracer("... Table column widths", fmt.Sprintf("%v", t.cellwidths))
+		if r.TableKeepTogether {
+			r.keepTableTogether(t, node)
+		}
+	} else {
+		r.Pdf.CellFormat(r.cs.peek().table.width(), 0, "", "T", 0, "", false, 0, "")
 
 		r.cs.pop()
 		r.tracer("Table (leaving)", "")
@@ -633,9 +1718,9 @@ func (r *PdfRenderer) processTableHead(node ast.Node, entering bool) {
 		r.tracer("TableHead (entering)", "")
 		x := &containerState{
 			textStyle: r.THeader, listkind: notlist,
-			leftMargin: r.cs.peek().leftMargin}
+			leftMargin: r.cs.peek().leftMargin,
+			table:      r.cs.peek().table}
 		r.cs.push(x)
-		cellwidths = make([]float64, 0)
 	} else {
 		r.cs.pop()
 		r.tracer("TableHead (leaving)", "")
@@ -647,33 +1732,60 @@ func (r *PdfRenderer) processTableBody(node ast.Node, entering bool) {
 		r.tracer("TableBody (entering)", "")
 		x := &containerState{
 			textStyle: r.TBody, listkind: notlist,
-			leftMargin: r.cs.peek().leftMargin}
+			leftMargin: r.cs.peek().leftMargin,
+			table:      r.cs.peek().table}
 		r.cs.push(x)
 	} else {
 		r.cs.pop()
 		r.tracer("TableBody (leaving)", "")
-		r.Pdf.Ln(-1)
+	}
+}
+
+func (r *PdfRenderer) processTableFooter(node ast.Node, entering bool) {
+	if entering {
+		r.tracer("TableFooter (entering)", "")
+		x := &containerState{
+			textStyle: r.TFooter, listkind: notlist,
+			leftMargin: r.cs.peek().leftMargin,
+			table:      r.cs.peek().table}
+		r.cs.push(x)
+	} else {
+		r.cs.pop()
+		r.tracer("TableFooter (leaving)", "")
 	}
 }
 
 func (r *PdfRenderer) processTableRow(node ast.Node, entering bool) {
 	if entering {
 		r.tracer("TableRow (entering)", "")
+		t := r.cs.peek().table
 		x := &containerState{
 			textStyle: r.TBody, listkind: notlist,
-			leftMargin: r.cs.peek().leftMargin}
+			leftMargin: r.cs.peek().leftMargin,
+			table:      t}
 		if r.cs.peek().isHeader {
 			x.textStyle = r.THeader
 		}
-		r.Pdf.Ln(-1)
+		// all cells of a row share the height of the tallest cell
+		x.rowHeight = r.tableRowHeight(t, node)
+		top, bottom := r.printableArea()
+		if _, y := r.Pdf.GetXY(); y+x.rowHeight > bottom && y > top {
+			_, inHeader := node.GetParent().(*ast.TableHeader)
+			r.tableBreakPage(t, !inHeader)
+		}
+		lm, _, _, _ := r.Pdf.GetMargins()
+		r.Pdf.SetX(lm)
+		_, x.rowTop = r.Pdf.GetXY()
+		r.tracer("... TableRow",
+			fmt.Sprintf("Top=%v, height=%v", x.rowTop, x.rowHeight))
 
-		// initialize cell widths slice; only one table at a time!
-		curdatacell = 0
+		t.curdatacell = 0
 		r.cs.push(x)
 	} else {
-		r.cs.pop()
+		row := r.cs.pop()
+		r.Pdf.SetY(row.rowTop + row.rowHeight)
 		r.tracer("TableRow (leaving)", "")
-		fill = !fill
+		row.table.fill = !row.table.fill
 	}
 }
 
@@ -681,22 +1793,559 @@ func (r *PdfRenderer) processTableCell(node ast.TableCell, entering bool) {
 	if entering {
 
 		r.tracer("TableCell (entering)", "")
+		t := r.cs.peek().table
 		x := &containerState{
 			textStyle: r.Normal, listkind: notlist,
-			leftMargin: r.cs.peek().leftMargin}
-		if node.IsHeader {
-			x.isHeader = true
-			x.textStyle = r.THeader
-			r.setStyler(r.THeader)
+			leftMargin: r.cs.peek().leftMargin,
+			table:      t}
+		x.isHeader = node.IsHeader
+		x.textStyle = r.cellStyler(&node)
+		rowHeight := r.cs.peek().rowHeight
+		r.cs.push(x)
+		r.drawTableCell(t, &node, t.cellwidths[t.curdatacell], rowHeight)
+	} else {
+		cell := r.cs.pop()
+		r.tracer("TableCell (leaving)", "")
+		cell.table.curdatacell++
+	}
+}
+
+// drawTableCell draws a cell with its text wrapped to width at the
+// current position, then moves the position to the next cell.
+func (r *PdfRenderer) drawTableCell(t *tableState, cell *ast.TableCell, width, rowHeight float64) {
+	style := r.cellStyler(cell)
+	r.setStyler(style)
+	border, cellFill := "LR", t.fill
+	if cell.IsHeader || isFooterCell(cell) {
+		border, cellFill = "1", true
+	}
+	cx, cy := r.Pdf.GetXY()
+	margin := r.Pdf.GetCellMargin()
+	lines := r.wrapRuns(r.cellRuns(cell), width-2*margin)
+	r.tracer("... table cell",
+		fmt.Sprintf("Width=%v, height=%v, lines=%v", width, rowHeight, len(lines)))
+	// background and borders span the full row height
+	r.Pdf.CellFormat(width, rowHeight, "", border, 0, "", cellFill, 0, "")
+	r.drawRuns(lines, cx, cy, width, margin, style.Size+style.Spacing, cellAlign(cell))
+	r.setStyler(style)
+	r.Pdf.SetXY(cx+width, cy)
+	for _, line := range lines {
+		for _, run := range line {
+			if run.note != nil {
+				r.placeFootnote(run.note)
+			}
+		}
+	}
+}
+
+// drawRuns draws wrapped lines of runs from the top of a box at x, y.
+// The lines are aligned within the width of the box less margin on
+// each side.
+func (r *PdfRenderer) drawRuns(lines [][]cellRun, x, y, width, margin, lh float64, align string) {
+	for i, line := range lines {
+		lw := r.runsWidth(line)
+		lx := x + margin
+		switch align {
+		case "C":
+			lx = x + (width-lw)/2
+		case "R":
+			lx = x + width - margin - lw
+		}
+		for _, run := range line {
+			r.setStyler(run.style)
+			rw := r.Pdf.GetStringWidth(run.text)
+			ly := y + float64(i)*lh
+			if run.note != nil {
+				r.markFootnote(run.note, ly)
+				// raise the smaller footnote number
+				ly -= lh / 4
+			}
+			r.Pdf.SetXY(lx, ly)
+			// a cell exactly as wide as the centred text has no
+			// inner margin, so runs join up without gaps
+			r.Pdf.CellFormat(rw, lh, run.text, "", 0, "C", run.fill, run.internal, run.link)
+			lx += rw
+		}
+	}
+}
+
+// drawTableRow draws a whole row outside of the AST walk; it is used to
+// repeat the header rows of a table on a new page.
+func (r *PdfRenderer) drawTableRow(t *tableState, row ast.Node) {
+	height := r.tableRowHeight(t, row)
+	lm, _, _, _ := r.Pdf.GetMargins()
+	r.Pdf.SetX(lm)
+	_, y := r.Pdf.GetXY()
+	for col, c := range row.GetChildren() {
+		if cell, ok := c.(*ast.TableCell); ok && col < len(t.cellwidths) {
+			r.drawTableCell(t, cell, t.cellwidths[col], height)
+		}
+	}
+	r.Pdf.SetY(y + height)
+	t.fill = !t.fill
+}
+
+// tableBreakPage closes the table at the bottom of the current page and
+// continues it on a new page, starting again with the header rows.
+func (r *PdfRenderer) tableBreakPage(t *tableState, repeatHeader bool) {
+	r.tracer("... Table", "page break")
+	lm, _, _, _ := r.Pdf.GetMargins()
+	r.Pdf.SetX(lm)
+	r.Pdf.CellFormat(t.width(), 0, "", "T", 0, "", false, 0, "")
+	r.addPage()
+	t.fill = false
+	if repeatHeader && t.header != nil {
+		r.tracer("... Table", "repeating header")
+		for _, row := range t.header.GetChildren() {
+			r.drawTableRow(t, row)
+		}
+	}
+}
+
+// keepTableTogether starts a new page when a table that fits on one
+// page would otherwise be broken across two.
+func (r *PdfRenderer) keepTableTogether(t *tableState, table ast.Node) {
+	height := 0.0
+	for _, row := range tableRows(table) {
+		height += r.tableRowHeight(t, row)
+	}
+	top, bottom := r.printableArea()
+	if _, y := r.Pdf.GetXY(); y+height > bottom && height <= bottom-top && y > top {
+		r.tracer("... Table", fmt.Sprintf("height=%v, keeping together on a new page", height))
+		r.addPage()
+	}
+}
+
+// printableArea returns the top margin and the position of the
+// automatic page break on the current page.
+func (r *PdfRenderer) printableArea() (top, bottom float64) {
+	_, pageh := r.Pdf.GetPageSize()
+	_, top, _, _ = r.Pdf.GetMargins()
+	_, bm := r.Pdf.GetAutoPageBreak()
+	return top, pageh - bm
+}
+
+// cellAlign returns the fpdf alignment for a cell from the delimiter
+// row of its column (e.g. "---:"). Columns without an alignment have
+// centred header cells and left aligned body cells.
+func cellAlign(cell *ast.TableCell) string {
+	switch cell.Align {
+	case ast.TableAlignmentLeft:
+		return "L"
+	case ast.TableAlignmentRight:
+		return "R"
+	case ast.TableAlignmentCenter:
+		return "C"
+	}
+	if cell.IsHeader {
+		return "C"
+	}
+	return "L"
+}
+
+// tableRows returns the rows of a table in document order.
+func tableRows(table ast.Node) []ast.Node {
+	var rows []ast.Node
+	for _, section := range table.GetChildren() {
+		for _, row := range section.GetChildren() {
+			if _, ok := row.(*ast.TableRow); ok {
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows
+}
+
+func isFooterCell(cell *ast.TableCell) bool {
+	if row := cell.GetParent(); row != nil {
+		_, ok := row.GetParent().(*ast.TableFooter)
+		return ok
+	}
+	return false
+}
+
+func (r *PdfRenderer) cellStyler(cell *ast.TableCell) Styler {
+	if cell.IsHeader {
+		return r.THeader
+	}
+	if isFooterCell(cell) {
+		return r.TFooter
+	}
+	return r.TBody
+}
+
+// processCaptionFigure numbers the captions of tables and of figures
+// (images, code blocks and quotes) separately, e.g. "Table 3: ...".
+func (r *PdfRenderer) processCaptionFigure(node *ast.CaptionFigure, entering bool) {
+	if entering {
+		label := "Figure"
+		number := 0
+		if _, ok := ast.GetFirstChild(node).(*ast.Table); ok {
+			label = "Table"
+			r.tableNumber++
+			number = r.tableNumber
 		} else {
-			x.textStyle = r.TBody
-			r.setStyler(r.TBody)
-			x.isHeader = false
+			r.figureNumber++
+			number = r.figureNumber
 		}
+		r.tracer("CaptionFigure (entering)", fmt.Sprintf("%v %v", label, number))
+		x := &containerState{
+			textStyle: r.cs.peek().textStyle, listkind: notlist,
+			leftMargin: r.cs.peek().leftMargin,
+			caption:    fmt.Sprintf("%v %v: ", label, number)}
 		r.cs.push(x)
+		if r.CaptionPosition == CaptionAbove {
+			for _, child := range node.GetChildren() {
+				if caption, ok := child.(*ast.Caption); ok {
+					r.cr()
+					ast.WalkFunc(caption, func(node ast.Node, entering bool) ast.WalkStatus {
+						return r.RenderNode(nil, node, entering)
+					})
+				}
+			}
+			x.captionDone = true
+		}
 	} else {
 		r.cs.pop()
-		r.tracer("TableCell (leaving)", "")
-		curdatacell++
+		r.tracer("CaptionFigure (leaving)", "")
+	}
+}
+
+// processCaption draws the caption of a table or figure, numbered by
+// processCaptionFigure, as runs of text like the caption of an image.
+func (r *PdfRenderer) processCaption(node *ast.Caption, entering bool) ast.WalkStatus {
+	figure := r.cs.peek()
+	if figure.captionDone {
+		if entering {
+			r.tracer("Caption", "already drawn")
+		}
+		return ast.SkipChildren
+	}
+	if !entering {
+		r.tracer("Caption (leaving)", "")
+		return ast.GoToNext
+	}
+	r.tracer("Caption (entering)", figure.caption)
+	label := r.Caption
+	label.Style += "b"
+	runs := append([]cellRun{{text: figure.caption, style: label}}, r.inlineRuns(node, r.Caption)...)
+	r.drawCaption(r.wrapRuns(mergeRuns(runs), r.contentWidth()), "")
+	return ast.SkipChildren
+}
+
+// tableColumnWidths measures the header and body cells of a table and
+// returns column widths that fit between the current margins. Columns
+// get their natural width (longest line) when there is room; otherwise
+// each column keeps room for its longest word and the remaining space is
+// shared out in proportion to how much each column would like to grow.
+func (r *PdfRenderer) tableColumnWidths(table ast.Node) []float64 {
+	padding := 2 * r.Pdf.GetCellMargin()
+	var natural, minimum []float64
+	for _, row := range tableRows(table) {
+		for col, c := range row.GetChildren() {
+			cell, ok := c.(*ast.TableCell)
+			if !ok {
+				continue
+			}
+			if col >= len(natural) {
+				natural = append(natural, 0)
+				minimum = append(minimum, 0)
+			}
+			words := r.splitRuns(r.cellRuns(cell))
+			nw := 0.0
+			for i, word := range words {
+				ww := r.runsWidth(word)
+				if i > 0 {
+					nw += r.spaceWidth(word[0].style)
+				}
+				nw += ww
+				minimum[col] = math.Max(minimum[col], ww+padding)
+			}
+			natural[col] = math.Max(natural[col], nw+(2*r.em))
+		}
+	}
+
+	pagew, _ := r.Pdf.GetPageSize()
+	lm, _, rm, _ := r.Pdf.GetMargins()
+	avail := pagew - lm - rm
+
+	var sumNatural, sumMinimum float64
+	for col := range natural {
+		minimum[col] = math.Min(minimum[col], natural[col])
+		sumNatural += natural[col]
+		sumMinimum += minimum[col]
+	}
+	if sumNatural <= avail {
+		return natural
+	}
+	widths := make([]float64, len(natural))
+	if sumMinimum >= avail {
+		// not even the longest words fit; columns that need no more
+		// than a fair share keep their width and the others share the
+		// rest, which means breaking their long words
+		fair := avail / float64(len(widths))
+		var kept, shared float64
+		for col := range widths {
+			if minimum[col] <= fair {
+				widths[col] = minimum[col]
+				kept += minimum[col]
+			} else {
+				shared += minimum[col]
+			}
+		}
+		for col := range widths {
+			if minimum[col] > fair {
+				widths[col] = minimum[col] * (avail - kept) / shared
+			}
+		}
+		return widths
+	}
+	extra := (avail - sumMinimum) / (sumNatural - sumMinimum)
+	for col := range widths {
+		widths[col] = minimum[col] + (natural[col]-minimum[col])*extra
+	}
+	return widths
+}
+
+// tableRowHeight returns the height of the tallest wrapped cell in a row.
+func (r *PdfRenderer) tableRowHeight(t *tableState, row ast.Node) float64 {
+	height := 0.0
+	for col, c := range row.GetChildren() {
+		cell, ok := c.(*ast.TableCell)
+		if !ok || col >= len(t.cellwidths) {
+			continue
+		}
+		style := r.cellStyler(cell)
+		lines := r.wrapRuns(r.cellRuns(cell), t.cellwidths[col]-2*r.Pdf.GetCellMargin())
+		height = math.Max(height, float64(len(lines))*(style.Size+style.Spacing))
+	}
+	return height
+}
+
+// cellRun is a piece of table cell or footnote text drawn in a single
+// style.
+type cellRun struct {
+	text  string
+	style Styler
+	fill  bool
+	link  string
+	// an fpdf internal link, which takes precedence over link
+	internal int
+	// set if the run is the marker of a footnote
+	note *footnote
+}
+
+// cellRuns flattens the inline content of a table cell into runs of
+// text.
+func (r *PdfRenderer) cellRuns(cell *ast.TableCell) []cellRun {
+	return r.inlineRuns(cell, r.cellStyler(cell))
+}
+
+// inlineRuns flattens the inline content of a node into runs of text,
+// applying emphasis, strong, strikethrough, code and link styles the
+// same way the processXxx functions do for running text.
+func (r *PdfRenderer) inlineRuns(parent ast.Node, style Styler) []cellRun {
+	var runs []cellRun
+	styles := []Styler{style}
+	links := []string{""}
+	anchors := []int{0}
+	ast.WalkFunc(parent, func(node ast.Node, entering bool) ast.WalkStatus {
+		current := styles[len(styles)-1]
+		switch node := node.(type) {
+		case *ast.Text:
+			if entering {
+				runs = append(runs, cellRun{text: strings.ReplaceAll(string(node.Literal), "\n", " "),
+					style: current, link: links[len(links)-1], internal: anchors[len(anchors)-1]})
+			}
+		case *ast.Code:
+			if entering {
+				runs = append(runs, cellRun{text: string(node.Literal),
+					style: r.Backtick, fill: true, link: links[len(links)-1], internal: anchors[len(anchors)-1]})
+			}
+		case *ast.Softbreak, *ast.Hardbreak:
+			runs = append(runs, cellRun{text: " ", style: current})
+		case *ast.Emph:
+			styles = pushStyle(styles, "i", entering)
+		case *ast.Strong:
+			styles = pushStyle(styles, "b", entering)
+		case *ast.Del:
+			styles = pushStyle(styles, "s", entering)
+		case *ast.Link:
+			if node.NoteID > 0 {
+				if entering {
+					fn := r.footnote(node.Footnote, node.NoteID)
+					marker := current
+					marker.Size *= 0.6
+					marker.TextColor = r.Link.TextColor
+					runs = append(runs, cellRun{text: strconv.Itoa(fn.number),
+						style: marker, internal: fn.noteLink, note: fn})
+				}
+				return ast.SkipChildren
+			}
+			if entering {
+				link := r.Link
+				if strings.Contains(current.Style, "s") {
+					link.Style += "s"
+				}
+				styles = append(styles, link)
+				destination, anchor := r.resolveLink(string(node.Destination))
+				links = append(links, destination)
+				anchors = append(anchors, anchor)
+			} else {
+				styles = styles[:len(styles)-1]
+				links = links[:len(links)-1]
+				anchors = anchors[:len(anchors)-1]
+			}
+		}
+		return ast.GoToNext
+	})
+	return runs
+}
+
+// pushStyle adds a font style flag to a copy of the innermost style on
+// entering a node, and drops that copy again on leaving it. Emphasis in
+// italic text, e.g. a caption, is set upright instead, so that it shows.
+func pushStyle(styles []Styler, flag string, entering bool) []Styler {
+	if !entering {
+		return styles[:len(styles)-1]
+	}
+	s := styles[len(styles)-1]
+	if flag == "i" && strings.Contains(s.Style, "i") {
+		s.Style = strings.ReplaceAll(s.Style, "i", "")
+	} else {
+		s.Style += flag
+	}
+	return append(styles, s)
+}
+
+// splitRuns breaks runs into words. A word may be made up of several
+// runs, e.g. "**bold**," is one word with a bold and a regular run.
+func (r *PdfRenderer) splitRuns(runs []cellRun) [][]cellRun {
+	var words [][]cellRun
+	var word []cellRun
+	for _, run := range runs {
+		for i, part := range strings.Split(run.text, " ") {
+			if i > 0 && len(word) > 0 {
+				words = append(words, word)
+				word = nil
+			}
+			if part != "" {
+				run.text = part
+				word = append(word, run)
+			}
+		}
+	}
+	if len(word) > 0 {
+		words = append(words, word)
+	}
+	return words
+}
+
+// wrapRuns breaks runs into lines no wider than w. Words that are wider
+// than w on their own are broken between characters.
+func (r *PdfRenderer) wrapRuns(runs []cellRun, w float64) [][]cellRun {
+	// allow for rounding when w was derived from a measured width
+	w += 1e-6
+	var lines [][]cellRun
+	var line []cellRun
+	lineWidth := 0.0
+	for _, word := range r.splitRuns(runs) {
+		ww := r.runsWidth(word)
+		if len(line) > 0 {
+			sw := r.spaceWidth(word[0].style)
+			if lineWidth+sw+ww <= w {
+				// the space belongs to a code span or link that
+				// carries on past it
+				space := cellRun{text: " ", style: word[0].style}
+				if prev := line[len(line)-1]; prev.fill == word[0].fill && prev.link == word[0].link &&
+					prev.internal == word[0].internal {
+					space.fill, space.link, space.internal = prev.fill, prev.link, prev.internal
+				}
+				line = append(line, space)
+				line = append(line, word...)
+				lineWidth += sw + ww
+				continue
+			}
+			lines = append(lines, mergeRuns(line))
+		}
+		for ww > w {
+			var head []cellRun
+			head, word = r.breakRuns(word, w)
+			lines = append(lines, mergeRuns(head))
+			ww = r.runsWidth(word)
+		}
+		line, lineWidth = word, ww
+	}
+	if len(line) > 0 || len(lines) == 0 {
+		lines = append(lines, mergeRuns(line))
+	}
+	return lines
+}
+
+// breakRuns splits a word into the longest head no wider than w, and
+// the rest. The head holds at least one character.
+func (r *PdfRenderer) breakRuns(word []cellRun, w float64) (head, tail []cellRun) {
+	width := 0.0
+	for n, run := range word {
+		r.setStyler(run.style)
+		rw := r.Pdf.GetStringWidth(run.text)
+		if width+rw <= w {
+			width += rw
+			continue
+		}
+		// the break falls inside this run
+		cut := 0
+		for i := range run.text {
+			if i > 0 && width+r.Pdf.GetStringWidth(run.text[:i]) > w {
+				break
+			}
+			cut = i
+		}
+		if cut == 0 && n == 0 {
+			_, cut = utf8.DecodeRuneInString(run.text)
+		}
+		head = append(head, word[:n]...)
+		if cut > 0 {
+			h := run
+			h.text = run.text[:cut]
+			head = append(head, h)
+		}
+		tail = append(tail, word[n+1:]...)
+		if cut < len(run.text) {
+			t := run
+			t.text = run.text[cut:]
+			tail = append([]cellRun{t}, tail...)
+		}
+		return head, tail
 	}
+	return word, nil
+}
+
+// mergeRuns joins neighbouring runs that are drawn the same way.
+func mergeRuns(runs []cellRun) []cellRun {
+	var merged []cellRun
+	for _, run := range runs {
+		if n := len(merged); n > 0 && merged[n-1].style == run.style &&
+			merged[n-1].fill == run.fill && merged[n-1].link == run.link &&
+			merged[n-1].internal == run.internal && merged[n-1].note == run.note {
+			merged[n-1].text += run.text
+			continue
+		}
+		merged = append(merged, run)
+	}
+	return merged
+}
+
+func (r *PdfRenderer) runsWidth(runs []cellRun) float64 {
+	width := 0.0
+	for _, run := range runs {
+		r.setStyler(run.style)
+		width += r.Pdf.GetStringWidth(run.text)
+	}
+	return width
+}
+
+func (r *PdfRenderer) spaceWidth(s Styler) float64 {
+	r.setStyler(s)
+	return r.Pdf.GetStringWidth(" ")
 }
@@ -0,0 +1,171 @@
+/*
+ * Markdown to PDF Converter
+ * Available at http://github.com/mandolyte/mdtopdf
+ *
+ * Copyright © Cecil New <cecil.new@gmail.com>, Jesse Portnoy <jesse@packman.io>.
+ * Distributed under the MIT License.
+ * See README.md for details.
+ *
+ * Dependencies
+ * This package depends on two other packages:
+ *
+ * Go Markdown processor
+ *   Available at https://github.com/gomarkdown/markdown
+ *
+ * fpdf - a PDF document generator with high level support for
+ *   text, drawing and images.
+ *   Available at https://github.com/go-pdf/fpdf
+ */
+
+package mdtopdf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// HighlightStyle is the colour and weight of the tokens of a syntax
+// highlighting group. Style is as for a Styler: "b", "i", "bi" or "".
+type HighlightStyle struct {
+	TextColor Color
+	Style     string
+}
+
+// UnmarshalJSON reads a style such as {"color": "#859900", "style": "b"};
+// the colour is anything Colorlookup takes.
+func (s *HighlightStyle) UnmarshalJSON(data []byte) error {
+	var style struct {
+		Color string `json:"color"`
+		Style string `json:"style"`
+	}
+	if err := json.Unmarshal(data, &style); err != nil {
+		return err
+	}
+	*s = HighlightStyle{TextColor: Colorlookup(style.Color), Style: style.Style}
+	return nil
+}
+
+// HighlightPalette maps gohighlight groups, e.g. "statement" or
+// "constant.string", to the style of their tokens in code blocks. A group
+// missing from the palette takes the style of its parent group,
+// "constant" for "constant.string", and tokens of no group in the
+// palette keep the style of the code block; a "default" entry, if any,
+// styles the tokens of no group.
+type HighlightPalette map[string]HighlightStyle
+
+// style returns the style of a group, if the palette has one.
+func (p HighlightPalette) style(group string) (HighlightStyle, bool) {
+	if group == "" {
+		group = "default"
+	}
+	for {
+		if s, ok := p[group]; ok {
+			return s, true
+		}
+		i := strings.LastIndexByte(group, '.')
+		if i < 0 {
+			return HighlightStyle{}, false
+		}
+		group = group[:i]
+	}
+}
+
+// palette builds a HighlightPalette from colours as Colorlookup takes
+// them, with the groups of each colour separated by spaces; a group
+// ending in * is bold and one ending in / is italic.
+func palette(colors map[string]string) HighlightPalette {
+	p := HighlightPalette{}
+	for color, groups := range colors {
+		for _, group := range strings.Fields(groups) {
+			style := ""
+			switch {
+			case strings.HasSuffix(group, "*"):
+				style = "b"
+			case strings.HasSuffix(group, "/"):
+				style = "i"
+			}
+			p[strings.TrimRight(group, "*/")] = HighlightStyle{TextColor: Colorlookup(color), Style: style}
+		}
+	}
+	return p
+}
+
+// highlightPalettes are the palettes that come with the package. Groups
+// named after colours are used by some syntax files.
+var highlightPalettes = map[string]map[string]string{
+	// the colours code blocks have always had
+	"default": {
+		"rgb(42,170,138)":  "statement green",
+		"rgb(137,207,240)": "identifier blue",
+		"rgb(255,80,80)":   "preproc special type.keyword red",
+		"rgb(0,136,163)":   "constant constant.number constant.bool symbol.brackets identifier.var cyan",
+		"rgb(255,0,255)":   "constant.specialChar constant.string.url constant.string magenta",
+		"rgb(255,165,0)":   "type symbol.operator symbol.tag.extended yellow",
+		"rgb(82,204,0)":    "comment high.green",
+	},
+	"solarized-light": {
+		"#657b83": "default",
+		"#93a1a1": "comment/",
+		"#859900": "statement* keyword* green",
+		"#2aa198": "constant constant.string cyan",
+		"#268bd2": "identifier identifier.class blue",
+		"#cb4b16": "preproc identifier.macro",
+		"#b58900": "type yellow",
+		"#dc322f": "special constant.specialChar error red",
+		"#d33682": "todo* magenta",
+		"#6c71c4": "constant.number constant.bool",
+	},
+	"solarized-dark": {
+		"#839496": "default",
+		"#586e75": "comment/",
+		"#859900": "statement* keyword* green",
+		"#2aa198": "constant constant.string cyan",
+		"#268bd2": "identifier identifier.class blue",
+		"#cb4b16": "preproc identifier.macro",
+		"#b58900": "type yellow",
+		"#dc322f": "special constant.specialChar error red",
+		"#d33682": "todo* magenta",
+		"#6c71c4": "constant.number constant.bool",
+	},
+	"github": {
+		"#24292e": "default symbol",
+		"#6a737d": "comment/",
+		"#d73a49": "statement keyword type.keyword symbol.operator preproc red",
+		"#032f62": "constant.string constant.specialChar",
+		"#005cc5": "constant constant.number constant.bool identifier.var blue cyan",
+		"#6f42c1": "identifier identifier.class identifier.macro type magenta",
+		"#22863a": "symbol.tag special green",
+		"#e36209": "yellow",
+		"#b31d28": "error todo*",
+	},
+}
+
+// HighlightPaletteLookup returns a palette that comes with the package:
+// "default", the colours code blocks have always had, "solarized-light",
+// "solarized-dark" or "github".
+func HighlightPaletteLookup(name string) (HighlightPalette, bool) {
+	colors, ok := highlightPalettes[strings.ToLower(name)]
+	if !ok {
+		return nil, false
+	}
+	return palette(colors), true
+}
+
+// LoadHighlightPalette reads a palette from a JSON file of groups and
+// their styles, e.g.
+//
+//	{"statement": {"color": "#859900", "style": "b"},
+//	 "comment": {"color": "gray", "style": "i"}}
+func LoadHighlightPalette(file string) (HighlightPalette, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p HighlightPalette
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%v: %w", file, err)
+	}
+	return p, nil
+}